@@ -0,0 +1,134 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// WriteBatch collects puts, deletes and range deletes so that they
+// can be written together. A batch is logged as a single record and
+// applied to the memtable in one go, so readers see all of it or none
+// of it, and after a crash either every write in it is recovered or
+// none is. The zero value is an empty batch.
+//
+// A batch is encoded as the value of its log record:
+//
+//	count u32 | repeated { kind u8 | keylen uvarint | key | vallen uvarint | value }
+//
+// where a range delete holds the start of its range as the key and
+// the end as the value. The writes are given consecutive sequence
+// numbers in the order they were added, starting from the one in
+// the record.
+type WriteBatch struct {
+	data []byte
+}
+
+const batchHeaderLen = 4
+
+func (b *WriteBatch) add(kind byte, key string, val []byte) {
+	if len(b.data) < batchHeaderLen {
+		b.data = append(b.data[:0], 0, 0, 0, 0)
+	}
+	b.data = append(b.data, kind)
+	b.data = appendString(b.data, key)
+	b.data = binary.AppendUvarint(b.data, uint64(len(val)))
+	b.data = append(b.data, val...)
+	binary.LittleEndian.PutUint32(b.data, batchCount(b.data)+1)
+}
+
+// Put adds a write of val to key to the batch
+func (b *WriteBatch) Put(key string, val []byte) {
+	b.add(typePut, key, val)
+}
+
+// Del adds a delete of key to the batch
+func (b *WriteBatch) Del(key string) {
+	b.add(typeDel, key, nil)
+}
+
+// DelRange adds a delete of every key from start up to, but
+// not including, end to the batch
+func (b *WriteBatch) DelRange(start, end string) {
+	b.add(typeRangeDel, start, []byte(end))
+}
+
+// Len returns the number of writes in the batch
+func (b *WriteBatch) Len() int {
+	return int(batchCount(b.data))
+}
+
+// Reset empties the batch so it can be reused
+func (b *WriteBatch) Reset() {
+	b.data = b.data[:0]
+}
+
+// record returns a log record holding a copy of the batch
+func (b *WriteBatch) record() *DataRecord {
+	return NewDataRecord(typeBatch, 0, "", append([]byte(nil), b.data...))
+}
+
+// batchCount returns the number of writes in an encoded batch
+func batchCount(data []byte) uint32 {
+	if len(data) < batchHeaderLen {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(data)
+}
+
+// readBatch decodes the writes of an encoded batch whose first
+// write has sequence number seq. A range delete is returned with
+// the end of its range as the value.
+func readBatch(data []byte, seq uint64) ([]item, error) {
+	n := batchCount(data)
+	if n == 0 || uint64(n) > uint64(len(data)) {
+		return nil, ErrBadRecord
+	}
+	ops := make([]item, 0, n)
+	b := data[batchHeaderLen:]
+	for i := uint32(0); i < n; i++ {
+		if len(b) < 1 {
+			return nil, ErrBadRecord
+		}
+		op := item{kind: b[0], seq: seq + uint64(i)}
+		if op.kind != typePut && op.kind != typeDel && op.kind != typeRangeDel {
+			return nil, ErrBadRecord
+		}
+		var err error
+		op.key, b, err = readString(b[1:])
+		if err != nil {
+			return nil, ErrBadRecord
+		}
+		op.val, b, err = readBytes(b)
+		if err != nil {
+			return nil, ErrBadRecord
+		}
+		ops = append(ops, op)
+	}
+	if len(b) > 0 {
+		return nil, ErrBadRecord
+	}
+	return ops, nil
+}
+
+// Write applies every write in b to the tree atomically. An empty
+// batch writes nothing.
+func (t *LSMTree) Write(b *WriteBatch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+	err := t.stall.wait()
+	if err != nil {
+		return fmt.Errorf("[LSMTree.Write] calling stall.wait: %v", err)
+	}
+	t.mu.RLock()
+	err = t.mem.Write(b)
+	t.mu.RUnlock()
+	if err != nil {
+		return fmt.Errorf("[LSMTree.Write] calling mem.Write: %v", err)
+	}
+	err = t.maybeSeal()
+	if err != nil {
+		return fmt.Errorf("[LSMTree.Write] calling maybeSeal: %v", err)
+	}
+	return nil
+}
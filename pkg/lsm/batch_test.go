@@ -0,0 +1,165 @@
+package lsm
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLSMTree_WriteBatch(t *testing.T) {
+	db := openTestTree(t, t.TempDir())
+	defer db.Close()
+	for i := 0; i < 100; i++ {
+		if err := db.Put(makeKey(i), makeVal(i)); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+	}
+	snap := db.NewSnapshot()
+	defer snap.Release()
+	seq := db.mem.seq
+	var b WriteBatch
+	b.DelRange(makeKey(10), makeKey(20))
+	b.Put(makeKey(15), []byte("kept"))
+	b.Del(makeKey(50))
+	b.Put("new", []byte("value"))
+	if b.Len() != 4 {
+		t.Fatalf("len: got %d, want %d", b.Len(), 4)
+	}
+	if err := db.Write(&b); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	// every write in the batch gets a sequence number of its own
+	if db.mem.seq != seq+4 {
+		t.Fatalf("seq: got %d, want %d", db.mem.seq, seq+4)
+	}
+	check := func(when string) {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			v, err := db.Get(makeKey(i))
+			switch {
+			case i == 15:
+				if err != nil || string(v) != "kept" {
+					t.Fatalf("%s: get %q: got %q (%v), want %q", when, makeKey(i), v, err, "kept")
+				}
+			case i >= 10 && i < 20 || i == 50:
+				if err != ErrNotFound {
+					t.Fatalf("%s: get %q: expected deleted, got %q (%v)", when, makeKey(i), v, err)
+				}
+			default:
+				if err != nil || !bytes.Equal(v, makeVal(i)) {
+					t.Fatalf("%s: get %q: got %q (%v)", when, makeKey(i), v, err)
+				}
+			}
+			// the snapshot still sees what the batch deleted
+			if v, err := snap.Get(makeKey(i)); err != nil || !bytes.Equal(v, makeVal(i)) {
+				t.Fatalf("%s: snapshot get %q: got %q (%v)", when, makeKey(i), v, err)
+			}
+		}
+		if n, err := db.Count(); err != nil || n != 100-10+1 {
+			t.Fatalf("%s: count: got %d (%v), want %d", when, n, err, 100-10+1)
+		}
+		var keys []string
+		db.Iter(func(k string, v []byte) bool {
+			if k >= makeKey(9) && k <= makeKey(20) {
+				keys = append(keys, k)
+			}
+			return true
+		})
+		if len(keys) != 3 || keys[0] != makeKey(9) || keys[1] != makeKey(15) || keys[2] != makeKey(20) {
+			t.Fatalf("%s: iter: got %q", when, keys)
+		}
+		if e, err := db.Lower(makeKey(14)); err != nil || e.Key != makeKey(9) {
+			t.Fatalf("%s: lower: got %v (%v)", when, e, err)
+		}
+	}
+	check("in memtable")
+	if err := db.Flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	check("after flush")
+	if err := db.Compact(); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	check("after compaction")
+
+	// once nothing can see under it the range delete goes
+	snap.Release()
+	if err := db.Compact(); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	for _, meta := range db.manifest.tables() {
+		r := tableReader(t, db, meta.num)
+		if len(r.dels) != 0 {
+			t.Fatalf("table %d: got %d range deletes, want none", meta.num, len(r.dels))
+		}
+	}
+	if v, err := db.Get(makeKey(15)); err != nil || string(v) != "kept" {
+		t.Fatalf("get %q: got %q (%v), want %q", makeKey(15), v, err, "kept")
+	}
+}
+
+func TestLSMTree_WriteBatchRecover(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestTree(t, dir)
+	var b WriteBatch
+	b.Put("before", []byte("batch"))
+	b.DelRange("x", "z")
+	if err := db.Write(&b); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	b.Reset()
+	for i := 0; i < 10; i++ {
+		b.Put(makeKey(i), makeVal(i))
+	}
+	if err := db.Write(&b); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	seq := db.mem.seq
+	crashTestTree(t, db)
+
+	// the batches are recovered from the log as a whole
+	db = openTestTree(t, dir)
+	if db.mem.seq != seq {
+		t.Fatalf("seq: got %d, want %d", db.mem.seq, seq)
+	}
+	if n := db.mem.Len(); n != 12 {
+		t.Fatalf("memtable: got %d entries, want %d", n, 12)
+	}
+	for i := 0; i < 10; i++ {
+		if v, err := db.Get(makeKey(i)); err != nil || !bytes.Equal(v, makeVal(i)) {
+			t.Fatalf("get %q: got %q (%v)", makeKey(i), v, err)
+		}
+	}
+	crashTestTree(t, db)
+
+	// cut the last batch short, as a crash part way through writing it
+	// would. the batches are still in the oldest segment, the newer one
+	// was started on recovery and is empty.
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+walExt))
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("glob: %v", err)
+	}
+	path := paths[0]
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if err = os.Truncate(path, fi.Size()-10); err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+
+	db = openTestTree(t, dir)
+	defer db.Close()
+	if db.mem.seq != seq-10 {
+		t.Fatalf("seq: got %d, want %d", db.mem.seq, seq-10)
+	}
+	if !db.Has("before") {
+		t.Fatalf("expected the write before the batch to be recovered")
+	}
+	for i := 0; i < 10; i++ {
+		if db.Has(makeKey(i)) {
+			t.Fatalf("has %q: expected none of the batch to be recovered", makeKey(i))
+		}
+	}
+}
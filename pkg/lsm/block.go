@@ -0,0 +1,197 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// defaultRestartInterval is the number of entries between restart points
+const defaultRestartInterval = 16
+
+// Data blocks store each key as the length of the prefix it shares
+// with the key before it followed by the rest of the key. Every so
+// many entries a restart point stores a key in full, and the offsets
+// of the restart points are kept at the end of the block so a lookup
+// can binary search them and only decode the entries after one.
+//
+// data block:
+//	repeated { kind u8 | shared uvarint | unshared uvarint | vallen uvarint |
+//	           key[shared:] | value }
+//	restart offset u32 * n | n u32
+
+// blockBuilder builds a single data block
+type blockBuilder struct {
+	interval int      // entries between restart points
+	buf      []byte   // encoded entries
+	restarts []uint32 // offsets of the restart points
+	counter  int      // entries since the last restart point
+	lastKey  string
+}
+
+func newBlockBuilder(size, interval int) *blockBuilder {
+	if interval < 1 {
+		interval = defaultRestartInterval
+	}
+	return &blockBuilder{
+		interval: interval,
+		buf:      make([]byte, 0, size),
+	}
+}
+
+// add appends an entry, keys must be added in increasing order
+func (b *blockBuilder) add(key string, kind byte, val []byte) {
+	shared := 0
+	if b.counter < b.interval && len(b.restarts) > 0 {
+		shared = sharedPrefixLen(b.lastKey, key)
+	} else {
+		b.restarts = append(b.restarts, uint32(len(b.buf)))
+		b.counter = 0
+	}
+	b.buf = append(b.buf, kind)
+	b.buf = binary.AppendUvarint(b.buf, uint64(shared))
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(key)-shared))
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(val)))
+	b.buf = append(b.buf, key[shared:]...)
+	b.buf = append(b.buf, val...)
+	b.counter++
+	b.lastKey = key
+}
+
+func (b *blockBuilder) empty() bool {
+	return len(b.restarts) == 0
+}
+
+// size returns the size the block will be once finished
+func (b *blockBuilder) size() int {
+	return len(b.buf) + 4*len(b.restarts) + 4
+}
+
+// finish appends the restart points and returns the block, which
+// is only valid until the builder is reset
+func (b *blockBuilder) finish() []byte {
+	for _, off := range b.restarts {
+		b.buf = binary.LittleEndian.AppendUint32(b.buf, off)
+	}
+	return binary.LittleEndian.AppendUint32(b.buf, uint32(len(b.restarts)))
+}
+
+func (b *blockBuilder) reset() {
+	b.buf = b.buf[:0]
+	b.restarts = b.restarts[:0]
+	b.counter = 0
+	b.lastKey = ""
+}
+
+func sharedPrefixLen(a, b string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// block is a data block read back from a table
+type block struct {
+	data     []byte // the encoded entries
+	restarts []byte // restart offsets, 4 bytes each
+}
+
+func parseBlock(b []byte) (*block, error) {
+	if len(b) < 4 {
+		return nil, ErrCorrupt
+	}
+	n := int(binary.LittleEndian.Uint32(b[len(b)-4:]))
+	if n == 0 || n > (len(b)-4)/4 {
+		return nil, ErrCorrupt
+	}
+	end := len(b) - 4 - 4*n
+	return &block{data: b[:end], restarts: b[end : len(b)-4]}, nil
+}
+
+func (b *block) restart(i int) int {
+	return int(binary.LittleEndian.Uint32(b.restarts[4*i:]))
+}
+
+func (b *block) numRestarts() int {
+	return len(b.restarts) / 4
+}
+
+// decode decodes the entry at off given the key of the entry before
+// it, returning the entry and the offset of the next one
+func (b *block) decode(off int, prev string) (item, int, error) {
+	var it item
+	if off < 0 || off >= len(b.data) {
+		return it, 0, ErrCorrupt
+	}
+	it.kind = b.data[off]
+	if it.kind != typePut && it.kind != typeDel {
+		return it, 0, ErrCorrupt
+	}
+	off++
+	var lens [3]uint64
+	for i := range lens {
+		v, n := binary.Uvarint(b.data[off:])
+		if n <= 0 {
+			return it, 0, ErrCorrupt
+		}
+		lens[i] = v
+		off += n
+	}
+	shared, unshared, vlen := lens[0], lens[1], lens[2]
+	if shared > uint64(len(prev)) || uint64(len(b.data)-off) < unshared+vlen {
+		return it, 0, ErrCorrupt
+	}
+	it.key = prev[:shared] + string(b.data[off:off+int(unshared)])
+	off += int(unshared)
+	it.val = b.data[off : off+int(vlen) : off+int(vlen)]
+	return it, off + int(vlen), nil
+}
+
+// entries decodes every entry in the block
+func (b *block) entries() ([]item, error) {
+	var ents []item
+	var prev string
+	for off := 0; off < len(b.data); {
+		it, next, err := b.decode(off, prev)
+		if err != nil {
+			return nil, err
+		}
+		ents = append(ents, it)
+		prev, off = it.key, next
+	}
+	return ents, nil
+}
+
+// seek returns the first entry with a key greater than or equal to
+// key, or nil if there is none. The restart points are binary
+// searched for the last one before key and the entries from there
+// on are decoded until one is found.
+func (b *block) seek(key string) (*item, error) {
+	var err error
+	i := sort.Search(b.numRestarts(), func(i int) bool {
+		if err != nil {
+			return true
+		}
+		var it item
+		it, _, err = b.decode(b.restart(i), "")
+		return it.key >= key
+	})
+	if err != nil {
+		return nil, err
+	}
+	if i > 0 {
+		i--
+	}
+	var prev string
+	for off := b.restart(i); off < len(b.data); {
+		it, next, err := b.decode(off, prev)
+		if err != nil {
+			return nil, err
+		}
+		if it.key >= key {
+			return &it, nil
+		}
+		prev, off = it.key, next
+	}
+	return nil, nil
+}
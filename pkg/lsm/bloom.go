@@ -0,0 +1,95 @@
+package lsm
+
+import (
+	"hash/fnv"
+	"sync/atomic"
+)
+
+// defaultBitsPerKey gives a false positive rate of roughly one percent
+const defaultBitsPerKey = 10
+
+// bloomFilter is a bloom filter over the keys of an sstable, stored
+// as the bit array followed by a single byte holding the number of
+// probes. Probe positions come from double hashing a 64 bit FNV-1a
+// hash of the key.
+type bloomFilter []byte
+
+// bloomHash returns the hash of key used to build and probe filters
+func bloomHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// newBloomFilter builds a filter from the hashes of every key, using
+// bitsPerKey bits for each key
+func newBloomFilter(hashes []uint64, bitsPerKey int) bloomFilter {
+	// the optimal number of probes is bitsPerKey * ln(2)
+	k := bitsPerKey * 69 / 100
+	if k < 1 {
+		k = 1
+	}
+	if k > 30 {
+		k = 30
+	}
+	nbits := len(hashes) * bitsPerKey
+	if nbits < 64 {
+		nbits = 64
+	}
+	nbytes := (nbits + 7) / 8
+	nbits = nbytes * 8
+	f := make(bloomFilter, nbytes+1)
+	f[nbytes] = byte(k)
+	for _, h := range hashes {
+		lo, hi := uint32(h), uint32(h>>32)
+		for i := 0; i < k; i++ {
+			bit := (lo + uint32(i)*hi) % uint32(nbits)
+			f[bit/8] |= 1 << (bit % 8)
+		}
+	}
+	return f
+}
+
+// mayContain reports whether the key with hash h may be in the set
+// the filter was built from. It never returns false for a key that
+// was, and malformed filters match everything.
+func (f bloomFilter) mayContain(h uint64) bool {
+	if len(f) < 2 {
+		return true
+	}
+	nbits := uint32(len(f)-1) * 8
+	k := int(f[len(f)-1])
+	if k > 30 {
+		return true
+	}
+	lo, hi := uint32(h), uint32(h>>32)
+	for i := 0; i < k; i++ {
+		bit := (lo + uint32(i)*hi) % nbits
+		if f[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// FilterStats counts how the bloom filters of the sstables fared on
+// point lookups
+type FilterStats struct {
+	Hits           int64 // the filter let the lookup go on to read a block
+	Misses         int64 // the filter ruled the key out without a read
+	FalsePositives int64 // hits where the key turned out not to be there
+}
+
+type filterCounters struct {
+	hits           atomic.Int64
+	misses         atomic.Int64
+	falsePositives atomic.Int64
+}
+
+func (c *filterCounters) stats() FilterStats {
+	return FilterStats{
+		Hits:           c.hits.Load(),
+		Misses:         c.misses.Load(),
+		FalsePositives: c.falsePositives.Load(),
+	}
+}
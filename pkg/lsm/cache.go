@@ -0,0 +1,196 @@
+package lsm
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+const cacheShards = 16
+
+// BlockCache is a size bounded LRU cache of sstable blocks, keyed by
+// table file number and block offset, that can be shared by every
+// table of a tree. It is split into shards, each with its own lock
+// and an equal share of the capacity. Data blocks are cached after
+// they have been checked and decompressed.
+//
+// Blocks can also be pinned, as the index and filter blocks of an
+// open table are. A pinned block is never evicted, though it still
+// counts towards the size of the cache, and goes back on the LRU
+// list once its last pin is released. Table file numbers are never
+// reused, so the blocks of a deleted table simply age out.
+type BlockCache struct {
+	shards   [cacheShards]cacheShard
+	capacity int64
+	hits     atomic.Int64
+	misses   atomic.Int64
+}
+
+// CacheStats describes the state of a BlockCache
+type CacheStats struct {
+	Hits     int64
+	Misses   int64
+	Size     int64 // bytes of blocks held, pinned or not
+	Pinned   int64 // bytes of pinned blocks
+	Capacity int64
+}
+
+type cacheKey struct {
+	file   uint64
+	offset uint64
+}
+
+type cacheEntry struct {
+	key   cacheKey
+	value []byte
+	pins  int
+	elem  *list.Element // position in the LRU list, nil while pinned
+}
+
+type cacheShard struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	pinned   int64
+	lru      list.List // unpinned entries, most recently used first
+	entries  map[cacheKey]*cacheEntry
+}
+
+// NewBlockCache returns a cache holding up to capacity bytes of blocks
+func NewBlockCache(capacity int64) *BlockCache {
+	c := &BlockCache{capacity: capacity}
+	for i := range c.shards {
+		c.shards[i].capacity = capacity / cacheShards
+		c.shards[i].entries = make(map[cacheKey]*cacheEntry)
+	}
+	return c
+}
+
+func (c *BlockCache) shard(k cacheKey) *cacheShard {
+	h := k.file*0x9e3779b97f4a7c15 ^ k.offset*0xbf58476d1ce4e5b9
+	return &c.shards[h>>60]
+}
+
+// get returns the block cached under k
+func (c *BlockCache) get(k cacheKey) ([]byte, bool) {
+	s := c.shard(k)
+	s.mu.Lock()
+	e, ok := s.entries[k]
+	if ok && e.elem != nil {
+		s.lru.MoveToFront(e.elem)
+	}
+	s.mu.Unlock()
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	return e.value, true
+}
+
+// put caches a block under k, evicting the least recently
+// used blocks of its shard to make room for it
+func (c *BlockCache) put(k cacheKey, value []byte) {
+	s := c.shard(k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.entries[k]; ok {
+		return
+	}
+	e := &cacheEntry{key: k, value: value}
+	e.elem = s.lru.PushFront(e)
+	s.entries[k] = e
+	s.size += int64(len(value))
+	s.evict()
+}
+
+// pin returns the block cached under k, loading and caching it
+// first if need be, and keeps it cached until it is unpinned
+func (c *BlockCache) pin(k cacheKey, load func() ([]byte, error)) ([]byte, error) {
+	s := c.shard(k)
+	s.mu.Lock()
+	e, ok := s.entries[k]
+	if ok {
+		if e.elem != nil {
+			s.lru.Remove(e.elem)
+			e.elem = nil
+			s.pinned += int64(len(e.value))
+		}
+		e.pins++
+		s.mu.Unlock()
+		c.hits.Add(1)
+		return e.value, nil
+	}
+	s.mu.Unlock()
+	c.misses.Add(1)
+	value, err := load()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok = s.entries[k]; ok {
+		// someone else loaded it while we were
+		if e.elem != nil {
+			s.lru.Remove(e.elem)
+			e.elem = nil
+			s.pinned += int64(len(e.value))
+		}
+		e.pins++
+		return e.value, nil
+	}
+	s.entries[k] = &cacheEntry{key: k, value: value, pins: 1}
+	s.size += int64(len(value))
+	s.pinned += int64(len(value))
+	s.evict()
+	return value, nil
+}
+
+// unpin releases a pin taken by pin
+func (c *BlockCache) unpin(k cacheKey) {
+	s := c.shard(k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[k]
+	if !ok || e.pins == 0 {
+		return
+	}
+	e.pins--
+	if e.pins == 0 {
+		s.pinned -= int64(len(e.value))
+		e.elem = s.lru.PushFront(e)
+		s.evict()
+	}
+}
+
+// evict drops unpinned blocks, least recently used first, until
+// the shard fits its capacity. The caller must hold the lock.
+func (s *cacheShard) evict() {
+	for s.size > s.capacity {
+		back := s.lru.Back()
+		if back == nil {
+			return
+		}
+		e := back.Value.(*cacheEntry)
+		s.lru.Remove(back)
+		delete(s.entries, e.key)
+		s.size -= int64(len(e.value))
+	}
+}
+
+// Stats returns the hit and miss counts and current size of the cache
+func (c *BlockCache) Stats() CacheStats {
+	stats := CacheStats{
+		Hits:     c.hits.Load(),
+		Misses:   c.misses.Load(),
+		Capacity: c.capacity,
+	}
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		stats.Size += s.size
+		stats.Pinned += s.pinned
+		s.mu.Unlock()
+	}
+	return stats
+}
@@ -0,0 +1,79 @@
+package lsm
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestBlockCache_Evict(t *testing.T) {
+	c := NewBlockCache(16 << 10)
+	block := make([]byte, 100)
+	for i := 0; i < 1000; i++ {
+		c.put(cacheKey{file: 1, offset: uint64(i) * 100}, block)
+	}
+	stats := c.Stats()
+	if stats.Size > stats.Capacity || stats.Size < stats.Capacity/2 {
+		t.Fatalf("size: got %d, capacity %d", stats.Size, stats.Capacity)
+	}
+	// the most recent blocks survive, the oldest do not
+	if _, ok := c.get(cacheKey{file: 1, offset: 999 * 100}); !ok {
+		t.Errorf("get: expected the newest block to be cached")
+	}
+	if _, ok := c.get(cacheKey{file: 1, offset: 0}); ok {
+		t.Errorf("get: expected the oldest block to be evicted")
+	}
+	stats = c.Stats()
+	if stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("stats: got %+v", stats)
+	}
+}
+
+func TestBlockCache_Pin(t *testing.T) {
+	c := NewBlockCache(cacheShards * 1000)
+	k := cacheKey{file: 1, offset: 0}
+	var loads int
+	load := func() ([]byte, error) {
+		loads++
+		return bytes.Repeat([]byte{1}, 100), nil
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := c.pin(k, load); err != nil {
+			t.Fatalf("pin: %v", err)
+		}
+	}
+	if loads != 1 {
+		t.Fatalf("loads: got %d, want 1", loads)
+	}
+	// overfill the shard the pinned block lives in
+	s := c.shard(k)
+	for off, n := uint64(1), 0; n < 50; off++ {
+		if kk := (cacheKey{file: 2, offset: off}); c.shard(kk) == s {
+			c.put(kk, make([]byte, 60))
+			n++
+		}
+	}
+	if _, ok := c.get(k); !ok {
+		t.Fatalf("get: expected the pinned block to be cached")
+	}
+	if stats := c.Stats(); stats.Pinned != 100 {
+		t.Fatalf("pinned: got %d, want 100", stats.Pinned)
+	}
+	c.unpin(k)
+	if _, ok := c.get(k); !ok {
+		t.Fatalf("get: expected the block to be pinned until its last unpin")
+	}
+	c.unpin(k)
+	if stats := c.Stats(); stats.Pinned != 0 || stats.Size > stats.Capacity {
+		t.Fatalf("stats after unpin: got %+v", stats)
+	}
+
+	bad := errors.New("bad block")
+	_, err := c.pin(cacheKey{file: 3}, func() ([]byte, error) { return nil, bad })
+	if err != bad {
+		t.Fatalf("pin: got %v, want %v", err, bad)
+	}
+	if _, ok := c.get(cacheKey{file: 3}); ok {
+		t.Fatalf("get: expected failed loads not to be cached")
+	}
+}
@@ -1,7 +1,6 @@
 package lsm
 
 import (
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -14,57 +13,75 @@ const (
 	typeAdd = 0xf0 // insert type marker
 	typePut = 0xf1 // update type marker
 	typeDel = 0xf2 // delete type marker
+
+	typeRangeDel = 0xf3 // range delete type marker
+	typeBatch    = 0xf4 // write batch type marker
 )
 
 var ErrNotFound = errors.New("not found")
 
-func readEntry(r io.Reader) (string, []byte, error) {
-	header := make([]byte, 12)
-	_, err := r.Read(header)
+// item is a single record as it is stored in the memtable and in
+// sstables. kind is typePut for a live value or typeDel for a
+// tombstone marking the key as deleted, and seq is the sequence
+// number of the write.
+type item struct {
+	key  string
+	seq  uint64
+	kind byte
+	val  []byte
+}
+
+// writeRecord encodes rec and writes it to w with a single call
+// to Write, returning the number of bytes written
+func writeRecord(w io.Writer, rec *DataRecord) (int, error) {
+	data, err := rec.MarshalBinary()
 	if err != nil {
-		if err == io.EOF {
-			return "", nil, err
-		}
-		return "", nil, fmt.Errorf("[readEntry] reading header: %v", err)
+		return 0, fmt.Errorf("[writeRecord] encoding record: %v", err)
 	}
-
-	keylen := binary.LittleEndian.Uint32(header[0:4])
-	vallen := binary.LittleEndian.Uint64(header[4:12])
-
-	data := make([]byte, uint64(keylen)+vallen)
-	_, err = r.Read(data)
+	n, err := w.Write(data)
 	if err != nil {
-		return "", nil, fmt.Errorf("[readEntry] reading data: %v", err)
+		return n, fmt.Errorf("[writeRecord] writing record: %v", err)
 	}
-	return string(data[:keylen]), data[keylen : uint64(keylen)+vallen], nil
+	return n, nil
 }
 
-func writeEntry(w io.Writer, key string, val []byte) error {
-	// write keylen
-	var keylen [4]byte
-	binary.LittleEndian.PutUint32(keylen[:], uint32(len(key)))
-	_, err := w.Write(keylen[:])
+// readRecord reads one full record from r and returns it along with
+// the number of bytes consumed. remain is the number of bytes left
+// in r. It returns io.EOF if r ends on a record boundary and
+// io.ErrUnexpectedEOF if it ends part way through a record, which
+// is what a write torn by a crash looks like, but also what corrupt
+// lengths claiming more than is left look like. A complete record
+// that fails its checksum or is otherwise malformed returns
+// ErrBadChecksum or ErrBadRecord, having consumed the whole record
+// so the caller may skip over it.
+func readRecord(r io.Reader, remain int64) (*DataRecord, int, error) {
+	header := make([]byte, recordHeaderLen)
+	n, err := io.ReadFull(r, header)
 	if err != nil {
-		return fmt.Errorf("[writeEntry] writing key length: %v", err)
+		return nil, n, err
 	}
-	// write vallen
-	var vallen [8]byte
-	binary.LittleEndian.PutUint64(vallen[:], uint64(len(val)))
-	_, err = w.Write(vallen[:])
-	if err != nil {
-		return fmt.Errorf("[writeEntry] writing value length: %v", err)
+	klen, vlen := recordLengths(header)
+	if int64(klen+vlen) > remain-int64(n) {
+		// don't trust the lengths enough to allocate
+		// more than could possibly be in the file
+		return nil, n, io.ErrUnexpectedEOF
+	}
+	data := make([]byte, recordHeaderLen+klen+vlen)
+	copy(data, header)
+	m, err := io.ReadFull(r, data[recordHeaderLen:])
+	n += m
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
 	}
-	// write key data
-	_, err = w.Write([]byte(key))
 	if err != nil {
-		return fmt.Errorf("[writeEntry] writing key data: %v", err)
+		return nil, n, err
 	}
-	// write val data
-	_, err = w.Write(val)
+	rec := new(DataRecord)
+	err = rec.decode(data, klen)
 	if err != nil {
-		return fmt.Errorf("[writeEntry] writing value data: %v", err)
+		return nil, n, err
 	}
-	return nil
+	return rec, n, nil
 }
 
 const filePermissions = 0600 //| os.ModeSticky
@@ -100,3 +117,44 @@ func openOrCreate(path string) (*os.File, error) {
 	}
 	return fd, nil
 }
+
+// syncDir fsyncs a directory so that files created, renamed or
+// removed in it are durable
+func syncDir(dir string) error {
+	fd, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("[syncDir] opening: %v", err)
+	}
+	err = fd.Sync()
+	if err != nil {
+		fd.Close()
+		return fmt.Errorf("[syncDir] calling fd.Sync: %v", err)
+	}
+	return fd.Close()
+}
+
+// writeFileAtomic replaces the file at path with data by writing a
+// temporary file, syncing it and renaming it over the original
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	fd, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, filePermissions)
+	if err != nil {
+		return fmt.Errorf("[writeFileAtomic] opening: %v", err)
+	}
+	_, err = fd.Write(data)
+	if err == nil {
+		err = fd.Sync()
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("[writeFileAtomic] writing: %v", err)
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return fmt.Errorf("[writeFileAtomic] calling os.Rename: %v", err)
+	}
+	return syncDir(filepath.Dir(path))
+}
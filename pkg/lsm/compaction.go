@@ -0,0 +1,680 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Tables are organised into levels. Level 0 holds the tables written
+// by memtable flushes, which may overlap one another and are kept in
+// the order their data was written. Deeper levels are used however the
+// compaction strategy sees fit; the leveled strategy keeps each one as
+// a single sorted run of tables with disjoint key ranges, holding older
+// data than the levels above it.
+
+// TableInfo describes a live sstable to a CompactionStrategy
+type TableInfo struct {
+	Level    int
+	Num      uint64 // file number, unique to the table
+	Size     int64
+	Smallest string
+	Largest  string
+}
+
+// Compaction is a set of tables picked by a CompactionStrategy to be
+// merged together into new tables on a single level. If Inputs are
+// taken from level 0 they must be a run of tables next to each other
+// in level 0, so that no table outside the run sits between them in age.
+type Compaction struct {
+	Inputs []TableInfo // tables to merge, newest data first
+	Output int         // level the merged tables are written to
+}
+
+// CompactionStrategy decides which tables the tree merges together
+// and when. Pick is called after every flush and compaction, by one
+// goroutine at a time, and is handed the live tables level by level;
+// level 0 is ordered oldest first and every other level by smallest
+// key. It returns the next compaction to run, or nil if there is
+// nothing to do.
+type CompactionStrategy interface {
+	Pick(levels [][]TableInfo) *Compaction
+}
+
+// CompactionEstimator may be implemented by a CompactionStrategy to
+// report how far behind it is. PendingBytes is handed the live tables
+// the same way Pick is, whenever they change, and returns roughly how
+// many bytes of tables need compacting before nothing is left to pick.
+// The tree holds back writes once it grows too large.
+type CompactionEstimator interface {
+	PendingBytes(levels [][]TableInfo) int64
+}
+
+// LeveledCompaction keeps a size target for every level. Level 0 is
+// compacted into level 1 once it holds L0Trigger tables, and any
+// deeper level is compacted a table at a time into the level below it
+// once it grows past its target. Level 1 may hold BaseLevelSize bytes
+// and every level after that Multiplier times as much as the one
+// before it. Fields left at zero take their value from DefaultOptions.
+type LeveledCompaction struct {
+	L0Trigger     int
+	BaseLevelSize int64
+	Multiplier    int
+	MaxLevels     int
+
+	// mu guards ptr, which holds for each level the largest
+	// key of the last table compacted out of it
+	mu  sync.Mutex
+	ptr map[int]string
+}
+
+// levelTarget returns how many bytes level may
+// hold before it needs to be compacted
+func (s *LeveledCompaction) levelTarget(level int) int64 {
+	target := s.BaseLevelSize
+	for i := 1; i < level; i++ {
+		target *= int64(s.Multiplier)
+	}
+	return target
+}
+
+// Pick scores every level against its target, the number of tables
+// for level 0 and the number of bytes for the rest, and compacts the
+// level most over its target into the tables it overlaps in the next
+func (s *LeveledCompaction) Pick(levels [][]TableInfo) *Compaction {
+	opts := s.withDefaults()
+	level, best := -1, 0.0
+	for i := 0; i < len(levels) && i < opts.MaxLevels-1; i++ {
+		var score float64
+		if i == 0 {
+			score = float64(len(levels[0])) / float64(opts.L0Trigger)
+		} else {
+			score = float64(tablesSize(levels[i])) / float64(opts.levelTarget(i))
+		}
+		if score >= 1 && score > best {
+			level, best = i, score
+		}
+	}
+	if level < 0 {
+		return nil
+	}
+	c := &Compaction{Output: level + 1}
+	if level == 0 {
+		// level 0 tables overlap, so they all go at once
+		// and the newest has to come first
+		for i := len(levels[0]) - 1; i >= 0; i-- {
+			c.Inputs = append(c.Inputs, levels[0][i])
+		}
+	} else {
+		// work through the level in key order, one table at a
+		// time, starting after the last table compacted
+		s.mu.Lock()
+		if s.ptr == nil {
+			s.ptr = make(map[int]string)
+		}
+		pick := levels[level][0]
+		for _, t := range levels[level] {
+			if t.Smallest > s.ptr[level] {
+				pick = t
+				break
+			}
+		}
+		s.ptr[level] = pick.Largest
+		s.mu.Unlock()
+		c.Inputs = []TableInfo{pick}
+	}
+	if c.Output < len(levels) {
+		smallest, largest := tablesRange(c.Inputs)
+		for _, t := range levels[c.Output] {
+			if t.Largest >= smallest && t.Smallest <= largest {
+				c.Inputs = append(c.Inputs, t)
+			}
+		}
+	}
+	return c
+}
+
+// PendingBytes counts all of level 0 once it has reached its trigger,
+// and every byte any deeper level holds past its target
+func (s *LeveledCompaction) PendingBytes(levels [][]TableInfo) int64 {
+	opts := s.withDefaults()
+	var pending int64
+	for i := 0; i < len(levels) && i < opts.MaxLevels-1; i++ {
+		if i == 0 {
+			if len(levels[0]) >= opts.L0Trigger {
+				pending += tablesSize(levels[0])
+			}
+		} else if size := tablesSize(levels[i]); size > opts.levelTarget(i) {
+			pending += size - opts.levelTarget(i)
+		}
+	}
+	return pending
+}
+
+// withDefaults returns the settings of s with every
+// field that is not usable taken from DefaultOptions
+func (s *LeveledCompaction) withDefaults() *LeveledCompaction {
+	opts := &LeveledCompaction{
+		L0Trigger:     s.L0Trigger,
+		BaseLevelSize: s.BaseLevelSize,
+		Multiplier:    s.Multiplier,
+		MaxLevels:     s.MaxLevels,
+	}
+	def := DefaultOptions
+	if opts.L0Trigger < 1 {
+		opts.L0Trigger = def.L0CompactionTrigger
+	}
+	if opts.BaseLevelSize <= 0 {
+		opts.BaseLevelSize = def.BaseLevelSize
+	}
+	if opts.Multiplier < 2 {
+		opts.Multiplier = def.LevelSizeMultiplier
+	}
+	if opts.MaxLevels < 2 {
+		opts.MaxLevels = def.MaxLevels
+	}
+	return opts
+}
+
+// SizeTieredCompaction leaves every table on level 0 and merges
+// tables of a similar size together, trading space for less write
+// amplification. Neighbouring tables are grouped into a bucket while
+// each one is within BucketLow and BucketHigh times the average size
+// of the bucket, or while they are all smaller than MinTableSize. Once
+// a bucket holds MinThreshold tables, up to MaxThreshold of them are
+// merged into one.
+type SizeTieredCompaction struct {
+	MinThreshold int
+	MaxThreshold int
+	BucketLow    float64
+	BucketHigh   float64
+	MinTableSize int64
+}
+
+var DefaultSizeTieredCompaction = SizeTieredCompaction{
+	MinThreshold: 4,
+	MaxThreshold: 32,
+	BucketLow:    0.5,
+	BucketHigh:   1.5,
+	MinTableSize: 1 << 20,
+}
+
+// Pick buckets the level 0 tables and merges the bucket of
+// the smallest tables that has reached the threshold
+func (s *SizeTieredCompaction) Pick(levels [][]TableInfo) *Compaction {
+	if len(levels) == 0 {
+		return nil
+	}
+	opts := s.withDefaults()
+	var pick []TableInfo
+	var pickAvg float64
+	for _, b := range opts.buckets(levels[0]) {
+		if len(b) < opts.MinThreshold {
+			continue
+		}
+		avg := float64(tablesSize(b)) / float64(len(b))
+		if pick == nil || avg < pickAvg {
+			pick, pickAvg = b, avg
+		}
+	}
+	if pick == nil {
+		return nil
+	}
+	c := &Compaction{Output: 0}
+	for i := len(pick) - 1; i >= 0; i-- {
+		c.Inputs = append(c.Inputs, pick[i])
+	}
+	return c
+}
+
+// PendingBytes counts every table in a bucket that has
+// reached the threshold
+func (s *SizeTieredCompaction) PendingBytes(levels [][]TableInfo) int64 {
+	if len(levels) == 0 {
+		return 0
+	}
+	opts := s.withDefaults()
+	var pending int64
+	for _, b := range opts.buckets(levels[0]) {
+		if len(b) >= opts.MinThreshold {
+			pending += tablesSize(b)
+		}
+	}
+	return pending
+}
+
+// buckets groups neighbouring tables of a similar size together
+func (s *SizeTieredCompaction) buckets(tables []TableInfo) [][]TableInfo {
+	var buckets [][]TableInfo
+	var bucket []TableInfo
+	var total int64
+	for _, t := range tables {
+		if len(bucket) > 0 {
+			avg := float64(total) / float64(len(bucket))
+			small := avg < float64(s.MinTableSize) && t.Size < s.MinTableSize
+			similar := float64(t.Size) >= avg*s.BucketLow && float64(t.Size) <= avg*s.BucketHigh
+			if (!small && !similar) || len(bucket) == s.MaxThreshold {
+				buckets = append(buckets, bucket)
+				bucket, total = nil, 0
+			}
+		}
+		bucket = append(bucket, t)
+		total += t.Size
+	}
+	return append(buckets, bucket)
+}
+
+func (s *SizeTieredCompaction) withDefaults() SizeTieredCompaction {
+	opts := *s
+	def := DefaultSizeTieredCompaction
+	if opts.MinThreshold < 2 {
+		opts.MinThreshold = def.MinThreshold
+	}
+	if opts.MaxThreshold < opts.MinThreshold {
+		opts.MaxThreshold = def.MaxThreshold
+		if opts.MaxThreshold < opts.MinThreshold {
+			opts.MaxThreshold = opts.MinThreshold
+		}
+	}
+	if opts.BucketLow <= 0 {
+		opts.BucketLow = def.BucketLow
+	}
+	if opts.BucketHigh <= 0 {
+		opts.BucketHigh = def.BucketHigh
+	}
+	if opts.MinTableSize <= 0 {
+		opts.MinTableSize = def.MinTableSize
+	}
+	return opts
+}
+
+func tablesSize(tables []TableInfo) int64 {
+	var size int64
+	for _, t := range tables {
+		size += t.Size
+	}
+	return size
+}
+
+func tablesRange(tables []TableInfo) (string, string) {
+	smallest, largest := tables[0].Smallest, tables[0].Largest
+	for _, t := range tables[1:] {
+		if t.Smallest < smallest {
+			smallest = t.Smallest
+		}
+		if t.Largest > largest {
+			largest = t.Largest
+		}
+	}
+	return smallest, largest
+}
+
+// compaction is a Compaction resolved against the manifest
+type compaction struct {
+	inputs []*tableMeta // tables to merge, newest data first
+	output int          // level the merged tables are written to
+	minSeq uint64       // oldest write held by any of the inputs
+	maxSeq uint64       // newest write held by any of the inputs
+	snaps  []uint64     // sequence numbers of the live snapshots, oldest first
+}
+
+// stripe returns the index of the oldest snapshot in c that can
+// see a write made at seq, or len(c.snaps) if none of them can.
+// Of the versions of a key falling in the same stripe only the
+// newest can be seen by anyone.
+func (c *compaction) stripe(seq uint64) int {
+	return sort.Search(len(c.snaps), func(i int) bool {
+		return c.snaps[i] >= seq
+	})
+}
+
+// stripeTop returns the newest write that falls in the given stripe
+func (c *compaction) stripeTop(stripe int) uint64 {
+	if stripe < len(c.snaps) {
+		return c.snaps[stripe]
+	}
+	return maxSequence
+}
+
+// overlapping returns the tables on level whose key
+// range overlaps the range from smallest to largest
+func (m *Manifest) overlapping(level int, smallest, largest string) []*tableMeta {
+	var tables []*tableMeta
+	if level < len(m.levels) {
+		for _, t := range m.levels[level] {
+			if t.largest >= smallest && t.smallest <= largest {
+				tables = append(tables, t)
+			}
+		}
+	}
+	return tables
+}
+
+// tableInfo returns the live tables for a CompactionStrategy
+func (m *Manifest) tableInfo() [][]TableInfo {
+	levels := make([][]TableInfo, len(m.levels))
+	for i, tables := range m.levels {
+		for _, t := range tables {
+			levels[i] = append(levels[i], TableInfo{
+				Level:    t.level,
+				Num:      t.num,
+				Size:     t.size,
+				Smallest: t.smallest,
+				Largest:  t.largest,
+			})
+		}
+	}
+	return levels
+}
+
+// pickCompaction asks the compaction strategy for the next
+// compaction to run and resolves it against the manifest
+func (t *LSMTree) pickCompaction() (*compaction, error) {
+	pc := t.opts.Compaction.Pick(t.manifest.tableInfo())
+	if pc == nil || len(pc.Inputs) == 0 {
+		return nil, nil
+	}
+	if pc.Output < 0 {
+		return nil, fmt.Errorf("[LSMTree.pickCompaction] bad output level %d", pc.Output)
+	}
+	live := make(map[uint64]*tableMeta)
+	for _, meta := range t.manifest.tables() {
+		live[meta.num] = meta
+	}
+	c := &compaction{output: pc.Output}
+	for _, in := range pc.Inputs {
+		meta := live[in.Num]
+		if meta == nil {
+			return nil, fmt.Errorf("[LSMTree.pickCompaction] table %d is not live", in.Num)
+		}
+		delete(live, in.Num)
+		c.inputs = append(c.inputs, meta)
+	}
+	return c, nil
+}
+
+// compactLevels runs compactions until the
+// compaction strategy has nothing left to do
+func (t *LSMTree) compactLevels() error {
+	for {
+		c, err := t.pickCompaction()
+		if err != nil || c == nil {
+			return err
+		}
+		err = t.runCompaction(c)
+		if err != nil {
+			return fmt.Errorf("[LSMTree.compactLevels] calling runCompaction: %v", err)
+		}
+	}
+}
+
+// runCompaction merges the input tables of c into new tables on the
+// output level, split at the target file size. Only the versions of
+// each key that the live tree or a live snapshot can see are kept, and
+// tombstones are dropped once nothing can see an older version of their
+// key through them. The new tables replace the inputs
+// in a single manifest edit, after which the inputs are deleted. A lone
+// input that overlaps nothing on the output level is simply moved.
+// The caller must hold bgMu, the tree lock is only taken to swap the
+// new tables in, so reads and writes carry on while tables are merged.
+func (t *LSMTree) runCompaction(c *compaction) error {
+	c.snaps = t.snapshotSeqs()
+	edit := new(versionEdit)
+	for _, meta := range c.inputs {
+		edit.delTable(meta.level, meta.num)
+		if c.minSeq == 0 || meta.minSeq < c.minSeq {
+			c.minSeq = meta.minSeq
+		}
+		if meta.maxSeq > c.maxSeq {
+			c.maxSeq = meta.maxSeq
+		}
+	}
+	if in := c.inputs[0]; len(c.inputs) == 1 && in.level != c.output &&
+		len(t.manifest.overlapping(c.output, in.smallest, in.largest)) == 0 {
+		meta := *in
+		meta.level = c.output
+		edit.addTable(&meta)
+		err := t.logAndApply(edit)
+		if err != nil {
+			return fmt.Errorf("[LSMTree.runCompaction] calling logAndApply: %v", err)
+		}
+		return nil
+	}
+
+	outputs, err := t.writeCompaction(c)
+	if err != nil {
+		for _, num := range outputs {
+			t.tables.remove(num)
+		}
+		return fmt.Errorf("[LSMTree.runCompaction] calling writeCompaction: %v", err)
+	}
+	for _, num := range outputs {
+		meta, err := t.newTableMeta(c.output, num, c.minSeq, c.maxSeq)
+		if err != nil {
+			for _, num := range outputs {
+				t.tables.remove(num)
+			}
+			return fmt.Errorf("[LSMTree.runCompaction] calling newTableMeta: %v", err)
+		}
+		edit.addTable(meta)
+	}
+	err = t.logAndApply(edit)
+	if err != nil {
+		// tables the edit may have made live are kept
+		if !errors.Is(err, errEditInDoubt) {
+			for _, num := range outputs {
+				t.tables.remove(num)
+			}
+		}
+		return fmt.Errorf("[LSMTree.runCompaction] calling logAndApply: %v", err)
+	}
+	// the inputs are only deleted once any reads still using them
+	// are done, the table cache takes care of that
+	for _, meta := range c.inputs {
+		err = t.tables.remove(meta.num)
+		if err != nil {
+			return fmt.Errorf("[LSMTree.runCompaction] calling tables.remove: %v", err)
+		}
+	}
+	return nil
+}
+
+// writeCompaction merges the inputs of c and writes them out as new
+// tables, returning the file number of each table written, even on
+// error. A version is dropped if a newer one of the same key, or a
+// newer range delete covering it, is seen by everyone who would see
+// it, and a tombstone or range delete if every snapshot sees it and
+// it no longer shadows anything. All the versions of a key go to the
+// same table, and range deletes are cut at the edges of the tables
+// so the tables written do not overlap.
+func (t *LSMTree) writeCompaction(c *compaction) ([]uint64, error) {
+	iters := make([]iterator, 0, len(c.inputs))
+	inputs := make(map[uint64]bool, len(c.inputs))
+	var dels []rangeDel
+	for _, meta := range c.inputs {
+		r, err := t.tables.acquire(meta.num)
+		if err != nil {
+			return nil, err
+		}
+		defer t.tables.release(meta.num)
+		iters = append(iters, r.iter())
+		inputs[meta.num] = true
+		dels = append(dels, r.dels...)
+	}
+	var keep []rangeDel
+	for _, d := range dels {
+		if c.stripe(d.seq) > 0 || !t.canDropRangeDel(inputs, d) {
+			keep = append(keep, d)
+		}
+	}
+	var outputs []uint64
+	var w *SSTableWriter
+	defer func() {
+		// the table being written when something went wrong
+		if w != nil {
+			w.Abort()
+		}
+	}()
+	openOutput := func() error {
+		num := t.manifest.newFileNum()
+		var err error
+		w, err = NewSSTableWriter(t.tablePath(num), t.tableOptions(c.output))
+		if err == nil {
+			outputs = append(outputs, num)
+		}
+		return err
+	}
+	// low is where the range deletes not yet written start from
+	var low string
+	addRangeDels := func(high string, last bool) {
+		for _, d := range keep {
+			if d.start < low {
+				d.start = low
+			}
+			if !last && d.end > high {
+				d.end = high
+			}
+			if d.start < d.end {
+				w.addRangeDel(d)
+			}
+		}
+		low = high
+	}
+	var prev string
+	prevStripe := -1
+	it := newMergeIterator(iters)
+	for it.seek(""); it.valid(); it.next() {
+		stripe := c.stripe(it.seq())
+		newKey := prevStripe < 0 || it.key() != prev
+		if !newKey && stripe == prevStripe {
+			// shadowed by a newer version of the key
+			continue
+		}
+		prev, prevStripe = it.key(), stripe
+		if coveringSeq(dels, it.key(), c.stripeTop(stripe)) > it.seq() {
+			// shadowed by a newer range delete
+			continue
+		}
+		if it.kind() == typeDel && stripe == 0 {
+			drop, err := t.canDropTombstone(inputs, it.key(), it.seq())
+			if err != nil {
+				return outputs, err
+			}
+			if drop {
+				continue
+			}
+		}
+		if w != nil && newKey && w.Size() >= t.opts.TargetFileSize {
+			addRangeDels(w.prevKey+"\x00", false)
+			if err := w.Close(); err != nil {
+				return outputs, err
+			}
+			w = nil
+		}
+		if w == nil {
+			if err := openOutput(); err != nil {
+				return outputs, err
+			}
+		}
+		err := w.add(it.key(), it.seq(), it.kind(), it.value())
+		if err != nil {
+			return outputs, err
+		}
+	}
+	if err := it.err(); err != nil {
+		return outputs, err
+	}
+	if w == nil && len(keep) > 0 {
+		if err := openOutput(); err != nil {
+			return outputs, err
+		}
+	}
+	if w != nil {
+		addRangeDels("", true)
+		if err := w.Close(); err != nil {
+			return outputs, err
+		}
+		w = nil
+	}
+	return outputs, nil
+}
+
+// canDropTombstone reports whether a tombstone for key written at seq
+// no longer shadows anything: no table outside the compaction holds an
+// older version of key. Tables whose key range does not cover key, or
+// that only hold newer writes, are ruled out without being read.
+func (t *LSMTree) canDropTombstone(inputs map[uint64]bool, key string, seq uint64) (bool, error) {
+	for level := range t.manifest.levels {
+		for _, meta := range t.manifest.overlapping(level, key, key) {
+			if inputs[meta.num] || meta.minSeq > seq {
+				continue
+			}
+			r, err := t.tables.acquire(meta.num)
+			if err != nil {
+				return false, err
+			}
+			it, err := r.lookup(key, seq)
+			t.tables.release(meta.num)
+			if err != nil {
+				return false, err
+			}
+			if it != nil {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// canDropRangeDel reports whether a range delete no longer shadows
+// anything: no table outside the compaction overlapping its range
+// holds writes older than it
+func (t *LSMTree) canDropRangeDel(inputs map[uint64]bool, d rangeDel) bool {
+	for level := range t.manifest.levels {
+		for _, meta := range t.manifest.overlapping(level, d.start, d.end) {
+			if !inputs[meta.num] && meta.minSeq <= d.seq {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Compact merges every sstable into a single sorted run on the
+// deepest level in use. Nothing is left for tombstones to shadow,
+// so they are dropped along with any versions they hide.
+func (t *LSMTree) Compact() error {
+	t.bgMu.Lock()
+	defer t.bgMu.Unlock()
+	inputs := t.manifest.tables()
+	if len(inputs) == 0 {
+		return nil
+	}
+	c := &compaction{inputs: inputs}
+	for _, meta := range inputs {
+		if meta.level > c.output {
+			c.output = meta.level
+		}
+	}
+	err := t.runCompaction(c)
+	if err != nil {
+		return fmt.Errorf("[LSMTree.Compact] calling runCompaction: %v", err)
+	}
+	return nil
+}
+
+// sortLevel0 orders level 0 tables by the age of the data they hold,
+// oldest first. Tables written by different flushes or compactions
+// hold disjoint sequence ranges, since only neighbouring runs of them
+// are ever merged. The tables one compaction splits its output into
+// all share the same range, but they hold disjoint keys, so they only
+// need to stay together; the file number keeps them in a stable order.
+func sortLevel0(tables []*tableMeta) {
+	sort.Slice(tables, func(i, j int) bool {
+		if tables[i].maxSeq != tables[j].maxSeq {
+			return tables[i].maxSeq < tables[j].maxSeq
+		}
+		return tables[i].num < tables[j].num
+	})
+}
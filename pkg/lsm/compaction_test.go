@@ -0,0 +1,375 @@
+package lsm
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func openCompactionTestTree(t *testing.T, dir string) *LSMTree {
+	db, err := Open(dir, &Options{
+		MemtableSize:        8 << 10,
+		L0CompactionTrigger: 2,
+		BaseLevelSize:       32 << 10,
+		LevelSizeMultiplier: 2,
+		TargetFileSize:      8 << 10,
+	})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	return db
+}
+
+// checkLevels makes sure level 0 is within its trigger and every
+// deeper level is a sorted run of tables with disjoint key ranges.
+// It waits out any flush or compaction running in the background.
+func checkLevels(t *testing.T, db *LSMTree) {
+	db.bgMu.Lock()
+	defer db.bgMu.Unlock()
+	levels := db.manifest.levels
+	if len(levels) > 0 && len(levels[0]) >= db.opts.L0CompactionTrigger {
+		t.Fatalf("level 0: got %d tables, trigger is %d", len(levels[0]), db.opts.L0CompactionTrigger)
+	}
+	for level := 1; level < len(levels); level++ {
+		for i := 1; i < len(levels[level]); i++ {
+			if levels[level][i-1].largest >= levels[level][i].smallest {
+				t.Fatalf("level %d: tables %d and %d overlap", level, i-1, i)
+			}
+		}
+	}
+}
+
+func TestLSMTree_LeveledCompaction(t *testing.T) {
+	dir := t.TempDir()
+	db := openCompactionTestTree(t, dir)
+	rnd := rand.New(rand.NewSource(1))
+	want := make(map[string][]byte)
+	for i := 0; i < 20000; i++ {
+		k := makeKey(rnd.Intn(3000))
+		if rnd.Intn(5) == 0 {
+			if _, err := db.Del(k); err != nil {
+				t.Fatalf("del: %v", err)
+			}
+			delete(want, k)
+			continue
+		}
+		v := []byte(fmt.Sprintf("%s-%d", k, i))
+		if err := db.Put(k, v); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+		want[k] = v
+	}
+	checkLevels(t, db)
+	if len(db.manifest.levels) < 3 {
+		t.Fatalf("levels: got %d, expected data to reach level 2", len(db.manifest.levels))
+	}
+	check := func() {
+		for i := 0; i < 3000; i++ {
+			k := makeKey(i)
+			val, err := db.Get(k)
+			if v, ok := want[k]; ok {
+				if err != nil || !bytes.Equal(val, v) {
+					t.Fatalf("get %q: got %q (%v), want %q", k, val, err, v)
+				}
+			} else if err != ErrNotFound {
+				t.Fatalf("get %q: got %q (%v), want deleted", k, val, err)
+			}
+		}
+		if n, _ := db.Count(); n != int64(len(want)) {
+			t.Fatalf("count: got %d, want %d", n, len(want))
+		}
+	}
+	check()
+	if err := db.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	db = openCompactionTestTree(t, dir)
+	defer db.Close()
+	checkLevels(t, db)
+	check()
+
+	// nothing lives below the deepest level, so
+	// it never needs to keep a tombstone around
+	deepest := db.manifest.levels[len(db.manifest.levels)-1]
+	for _, meta := range deepest {
+		it := tableReader(t, db, meta.num).iter()
+		for it.seek(""); it.valid(); it.next() {
+			if it.kind() == typeDel {
+				t.Fatalf("table %d: found tombstone for %q", meta.num, it.key())
+			}
+		}
+	}
+}
+
+func TestLSMTree_RangeDelCompaction(t *testing.T) {
+	db := openCompactionTestTree(t, t.TempDir())
+	defer db.Close()
+	rnd := rand.New(rand.NewSource(1))
+	want := make(map[string][]byte)
+	for i := 0; i < 20000; i++ {
+		if rnd.Intn(500) == 0 {
+			lo := rnd.Intn(3000)
+			hi := lo + rnd.Intn(200)
+			var b WriteBatch
+			b.DelRange(makeKey(lo), makeKey(hi))
+			if err := db.Write(&b); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			for j := lo; j < hi; j++ {
+				delete(want, makeKey(j))
+			}
+			continue
+		}
+		k := makeKey(rnd.Intn(3000))
+		v := []byte(fmt.Sprintf("%s-%d", k, i))
+		if err := db.Put(k, v); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+		want[k] = v
+	}
+	check := func(when string) {
+		checkLevels(t, db)
+		for i := 0; i < 3000; i++ {
+			k := makeKey(i)
+			val, err := db.Get(k)
+			if v, ok := want[k]; ok {
+				if err != nil || !bytes.Equal(val, v) {
+					t.Fatalf("%s: get %q: got %q (%v), want %q", when, k, val, err, v)
+				}
+			} else if err != ErrNotFound {
+				t.Fatalf("%s: get %q: got %q (%v), want deleted", when, k, val, err)
+			}
+		}
+		if n, _ := db.Count(); n != int64(len(want)) {
+			t.Fatalf("%s: count: got %d, want %d", when, n, len(want))
+		}
+	}
+	check("leveled")
+	if err := db.Compact(); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	check("compacted")
+	// range deletes are cut at the edges of the tables they span, and
+	// once everything is in a single run none of them are needed
+	for _, meta := range db.manifest.tables() {
+		if n := len(tableReader(t, db, meta.num).dels); n != 0 {
+			t.Fatalf("table %d: got %d range deletes, want none", meta.num, n)
+		}
+	}
+}
+
+func TestLSMTree_TrivialMove(t *testing.T) {
+	db := openCompactionTestTree(t, t.TempDir())
+	defer db.Close()
+	// two flushes of disjoint keys trigger a level 0 compaction,
+	// and with nothing in level 1 yet the tables can be merged
+	// straight into it; a third flush on its own then sits in
+	// level 0 until the next one arrives
+	for round := 0; round < 3; round++ {
+		for i := round * 10; i < round*10+10; i++ {
+			db.Put(makeKey(i), makeVal(i))
+		}
+		db.Flush()
+	}
+	levels := db.manifest.levels
+	if len(levels) != 2 || len(levels[0]) != 1 || len(levels[1]) != 1 {
+		t.Fatalf("levels: got %v", levels)
+	}
+	num := levels[0][0].num
+	// compacting a single level 0 table with nothing to
+	// overlap in level 1 just moves it down
+	c := &compaction{inputs: levels[0], output: 2}
+	if err := db.runCompaction(c); err != nil {
+		t.Fatalf("run compaction: %v", err)
+	}
+	if len(db.manifest.levels[2]) != 1 || db.manifest.levels[2][0].num != num {
+		t.Fatalf("move: got %v", db.manifest.levels)
+	}
+	if n, _ := db.Count(); n != 30 {
+		t.Fatalf("count: got %d, want %d", n, 30)
+	}
+}
+
+func TestSizeTieredCompaction_Pick(t *testing.T) {
+	s := &SizeTieredCompaction{MinThreshold: 3, MinTableSize: 10}
+	sizes := []int64{1000, 100, 110, 90, 5, 4, 1000}
+	var level0 []TableInfo
+	for i, size := range sizes {
+		level0 = append(level0, TableInfo{Num: uint64(i + 1), Size: size})
+	}
+	// the run of three similar sized tables is picked, newest first
+	c := s.Pick([][]TableInfo{level0})
+	if c == nil || c.Output != 0 || len(c.Inputs) != 3 {
+		t.Fatalf("pick: got %+v", c)
+	}
+	for i, num := range []uint64{4, 3, 2} {
+		if c.Inputs[i].Num != num {
+			t.Fatalf("pick: got input %d, want %d", c.Inputs[i].Num, num)
+		}
+	}
+	// a run of small tables shares a bucket and is preferred
+	level0 = append(level0[:6], TableInfo{Num: 7, Size: 8}, TableInfo{Num: 8, Size: 1000})
+	c = s.Pick([][]TableInfo{level0})
+	if c == nil || len(c.Inputs) != 3 || c.Inputs[0].Num != 7 {
+		t.Fatalf("pick small: got %+v", c)
+	}
+	// both full buckets are waiting to be compacted
+	if n := s.PendingBytes([][]TableInfo{level0}); n != 300+17 {
+		t.Fatalf("pending: got %d, want %d", n, 300+17)
+	}
+	if c = s.Pick([][]TableInfo{level0[:3]}); c != nil {
+		t.Fatalf("pick: expected nothing to do, got %+v", c)
+	}
+	if n := s.PendingBytes([][]TableInfo{level0[:3]}); n != 0 {
+		t.Fatalf("pending: got %d, want 0", n)
+	}
+}
+
+func TestLeveledCompaction_PendingBytes(t *testing.T) {
+	s := &LeveledCompaction{L0Trigger: 2, BaseLevelSize: 100, Multiplier: 10, MaxLevels: 4}
+	levels := [][]TableInfo{
+		{{Size: 10}, {Size: 20}},  // at its trigger, all of it
+		{{Size: 100}, {Size: 50}}, // 50 past its target
+		{{Size: 900}},             // under its target
+		{{Size: 1 << 20}},         // the last level is never compacted
+	}
+	if n := s.PendingBytes(levels); n != 80 {
+		t.Fatalf("pending: got %d, want %d", n, 80)
+	}
+	levels[0] = levels[0][:1]
+	if n := s.PendingBytes(levels); n != 50 {
+		t.Fatalf("pending: got %d, want %d", n, 50)
+	}
+}
+
+func TestLeveledCompaction_Pick(t *testing.T) {
+	// a zero value compacts level 0 once it holds
+	// as many tables as DefaultOptions says
+	s := &LeveledCompaction{}
+	var level0 []TableInfo
+	for i := 0; i < DefaultOptions.L0CompactionTrigger; i++ {
+		level0 = append(level0, TableInfo{Num: uint64(i + 1), Size: 10})
+	}
+	c := s.Pick([][]TableInfo{level0})
+	if c == nil || c.Output != 1 || len(c.Inputs) != len(level0) {
+		t.Fatalf("pick: got %+v", c)
+	}
+	if c = s.Pick([][]TableInfo{level0[1:]}); c != nil {
+		t.Fatalf("pick: expected nothing to do, got %+v", c)
+	}
+
+	// level 1 is worked through a table at a time, and
+	// Pick may be called from more than one goroutine
+	s = &LeveledCompaction{BaseLevelSize: 100}
+	var level1 []TableInfo
+	for i := 0; i < 8; i++ {
+		level1 = append(level1, TableInfo{
+			Num:      uint64(i + 1),
+			Size:     100,
+			Smallest: makeKey(i * 10),
+			Largest:  makeKey(i*10 + 9),
+		})
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if c := s.Pick([][]TableInfo{nil, level1}); c == nil || len(c.Inputs) != 1 {
+					t.Errorf("pick: got %+v", c)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestLSMTree_SizeTieredCompaction(t *testing.T) {
+	dir := t.TempDir()
+	opts := &Options{
+		MemtableSize: 8 << 10,
+		Compaction:   &SizeTieredCompaction{MinThreshold: 4, MinTableSize: 16 << 10},
+	}
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	rnd := rand.New(rand.NewSource(2))
+	want := make(map[string][]byte)
+	for i := 0; i < 10000; i++ {
+		k := makeKey(rnd.Intn(2000))
+		if rnd.Intn(5) == 0 {
+			db.Del(k)
+			delete(want, k)
+			continue
+		}
+		v := []byte(fmt.Sprintf("%s-%d", k, i))
+		db.Put(k, v)
+		want[k] = v
+	}
+	check := func() {
+		if len(db.manifest.levels) != 1 {
+			t.Fatalf("levels: got %d, want everything on level 0", len(db.manifest.levels))
+		}
+		if n := len(db.live); n >= 12 {
+			t.Fatalf("tables: got %d, expected them to have been merged", n)
+		}
+		for k, v := range want {
+			val, err := db.Get(k)
+			if err != nil || !bytes.Equal(val, v) {
+				t.Fatalf("get %q: got %q (%v), want %q", k, val, err, v)
+			}
+		}
+		if n, _ := db.Count(); n != int64(len(want)) {
+			t.Fatalf("count: got %d, want %d", n, len(want))
+		}
+	}
+	check()
+	if err = db.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	db, err = Open(dir, opts)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer db.Close()
+	check()
+}
+
+func TestLSMTree_LevelCompression(t *testing.T) {
+	db, err := Open(t.TempDir(), &Options{
+		L0CompactionTrigger: 2,
+		Compression:         []Compressor{nil, &FlateCompressor{Level: 6}},
+	})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer db.Close()
+	// the second flush compacts both tables into level 1
+	// and the third is left on level 0
+	for i := 0; i <= 500; i++ {
+		db.Put(makeKey(i), makeVal(i))
+		if i == 249 || i == 499 || i == 500 {
+			db.Flush()
+		}
+	}
+	levels := db.manifest.levels
+	if len(levels) < 2 || len(levels[0]) == 0 || len(levels[1]) == 0 {
+		t.Fatalf("levels: expected tables on levels 0 and 1, got %v", levels)
+	}
+	if id := blockCodec(t, tableReader(t, db, levels[0][0].num), 0); id != NoCompressionID {
+		t.Errorf("level 0 codec: got %d, want %d", id, NoCompressionID)
+	}
+	if id := blockCodec(t, tableReader(t, db, levels[1][0].num), 0); id != FlateID {
+		t.Errorf("level 1 codec: got %d, want %d", id, FlateID)
+	}
+	for i := 0; i <= 500; i++ {
+		if v, err := db.Get(makeKey(i)); err != nil || !bytes.Equal(v, makeVal(i)) {
+			t.Fatalf("get %q: got %q (%v)", makeKey(i), v, err)
+		}
+	}
+}
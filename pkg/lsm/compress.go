@@ -0,0 +1,121 @@
+package lsm
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Compressor compresses sstable data blocks. Each block records the
+// ID of the compressor it was written with, so a table may mix codecs
+// and stays readable as long as every codec it uses is registered.
+type Compressor interface {
+	// ID identifies the codec on disk and must never change
+	ID() byte
+	// Compress appends the compressed form of src to dst
+	Compress(dst, src []byte) ([]byte, error)
+	// Decompress appends the decompressed form of src to dst
+	Decompress(dst, src []byte) ([]byte, error)
+}
+
+// Codec IDs of the built in compressors. IDs below 64
+// are reserved for codecs that ship with the package.
+const (
+	NoCompressionID byte = 0
+	FlateID         byte = 1
+)
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = make(map[byte]Compressor)
+)
+
+func init() {
+	RegisterCompressor(NoCompression{})
+	RegisterCompressor(&FlateCompressor{Level: flate.DefaultCompression})
+}
+
+// RegisterCompressor makes a compressor available for reading the
+// blocks written with it, replacing any registered with the same ID
+func RegisterCompressor(c Compressor) {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	compressors[c.ID()] = c
+}
+
+func lookupCompressor(id byte) (Compressor, error) {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+	c, ok := compressors[id]
+	if !ok {
+		return nil, fmt.Errorf("sstable: unknown compressor id %d", id)
+	}
+	return c, nil
+}
+
+// NoCompression stores blocks as they are
+type NoCompression struct{}
+
+func (NoCompression) ID() byte { return NoCompressionID }
+
+func (NoCompression) Compress(dst, src []byte) ([]byte, error) {
+	return append(dst, src...), nil
+}
+
+func (NoCompression) Decompress(dst, src []byte) ([]byte, error) {
+	return append(dst, src...), nil
+}
+
+// FlateCompressor compresses blocks with DEFLATE at the given level,
+// any level accepted by compress/flate may be used. Every level reads
+// back the same way, so they all share a single ID.
+type FlateCompressor struct {
+	Level int
+
+	writers sync.Pool // *flate.Writer at Level
+	readers sync.Pool // io.ReadCloser implementing flate.Resetter
+}
+
+func (c *FlateCompressor) ID() byte { return FlateID }
+
+func (c *FlateCompressor) Compress(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	fw, _ := c.writers.Get().(*flate.Writer)
+	if fw == nil {
+		var err error
+		fw, err = flate.NewWriter(buf, c.Level)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		fw.Reset(buf)
+	}
+	defer c.writers.Put(fw)
+	_, err := fw.Write(src)
+	if err != nil {
+		return nil, err
+	}
+	err = fw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *FlateCompressor) Decompress(dst, src []byte) ([]byte, error) {
+	fr, _ := c.readers.Get().(io.ReadCloser)
+	if fr == nil {
+		fr = flate.NewReader(bytes.NewReader(src))
+	} else {
+		fr.(flate.Resetter).Reset(bytes.NewReader(src), nil)
+	}
+	defer c.readers.Put(fr)
+	buf := bytes.NewBuffer(dst)
+	_, err := buf.ReadFrom(fr)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -2,46 +2,131 @@ package lsm
 
 import (
 	"encoding/binary"
-	"time"
+	"errors"
+	"hash/crc32"
 )
 
+// DataRecord is the single record format used by the write ahead
+// log, both when writing and when replaying it.
+//
+//	+---------+---------+---------+------------+------------+-----+-------+
+//	| crc u32 | kind u8 | seq u64 | keylen u32 | vallen u32 | key | value |
+//	+---------+---------+---------+------------+------------+-----+-------+
+//
+// All integers are little endian. crc is the CRC32C (Castagnoli) of
+// every byte that follows it in the record. kind is one of typeAdd,
+// typePut or typeDel and seq is the sequence number assigned to the
+// write. A record of kind typeBatch holds a whole WriteBatch in its
+// value instead, and seq is the sequence number of its first write.
 type DataRecord struct {
-	Meta      uint64 // not used right now, but here for future use
-	Timestamp time.Time
-	Key       string
-	Value     []byte
+	Kind  byte
+	Seq   uint64
+	Key   string
+	Value []byte
 }
 
-func NewDataRecord(key string, value []byte) *DataRecord {
+const recordHeaderLen = 21
+
+var (
+	ErrBadRecord   = errors.New("logfile: malformed record")
+	ErrBadChecksum = errors.New("logfile: record checksum mismatch")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func NewDataRecord(kind byte, seq uint64, key string, value []byte) *DataRecord {
 	return &DataRecord{
-		Meta:      0,
-		Timestamp: time.Now(),
-		Key:       key,
-		Value:     value,
+		Kind:  kind,
+		Seq:   seq,
+		Key:   key,
+		Value: value,
 	}
 }
 
-func (d *DataRecord) UpdateTimestamp() {
-	d.Timestamp = time.Now()
+// lastSeq returns the sequence number of the last write in the record
+func (d *DataRecord) lastSeq() uint64 {
+	if d.Kind == typeBatch {
+		if n := batchCount(d.Value); n > 0 {
+			return d.Seq + uint64(n) - 1
+		}
+	}
+	return d.Seq
+}
+
+// Size returns the encoded size of the record in bytes
+func (d *DataRecord) Size() int {
+	return recordHeaderLen + len(d.Key) + len(d.Value)
 }
 
 func (d *DataRecord) MarshalBinary() ([]byte, error) {
-	data := make([]byte, 32+len(d.Key)+len(d.Value))
-	binary.LittleEndian.PutUint64(data[0:8], d.Meta)
-	binary.LittleEndian.PutUint64(data[8:16], uint64(d.Timestamp.Unix()))
-	binary.LittleEndian.PutUint64(data[16:24], uint64(len(d.Key)))
-	binary.LittleEndian.PutUint64(data[24:32], uint64(len(d.Value)))
-	copy(data[32:32+len(d.Key)], d.Key)
-	copy(data[32+len(d.Key):32+len(d.Key)+len(d.Value)], d.Value)
+	data := make([]byte, d.Size())
+	d.encodeHeader(data)
+	copy(data[recordHeaderLen:], d.Key)
+	copy(data[recordHeaderLen+len(d.Key):], d.Value)
+	binary.LittleEndian.PutUint32(data[0:4], crc32.Checksum(data[4:], crcTable))
 	return data, nil
 }
 
+func (d *DataRecord) encodeHeader(data []byte) {
+	data[4] = d.Kind
+	binary.LittleEndian.PutUint64(data[5:13], d.Seq)
+	binary.LittleEndian.PutUint32(data[13:17], uint32(len(d.Key)))
+	binary.LittleEndian.PutUint32(data[17:21], uint32(len(d.Value)))
+}
+
 func (d *DataRecord) UnmarshalBinary(data []byte) error {
-	d.Meta = binary.LittleEndian.Uint64(data[0:8])
-	d.Timestamp = time.Unix(int64(binary.LittleEndian.Uint64(data[8:16])), 0)
-	klen := binary.LittleEndian.Uint64(data[16:24])
-	vlen := binary.LittleEndian.Uint64(data[24:32])
-	d.Key = string(data[32 : 32+klen])
-	d.Value = data[32+klen : 32+klen+vlen]
+	if len(data) < recordHeaderLen {
+		return ErrBadRecord
+	}
+	klen, vlen := recordLengths(data)
+	if uint64(len(data)) != recordHeaderLen+klen+vlen {
+		return ErrBadRecord
+	}
+	return d.decode(data, klen)
+}
+
+// recordLengths returns the key and value lengths from a record
+// header. They can not be trusted until the checksum is verified.
+func recordLengths(header []byte) (uint64, uint64) {
+	klen := uint64(binary.LittleEndian.Uint32(header[13:17]))
+	vlen := uint64(binary.LittleEndian.Uint32(header[17:21]))
+	return klen, vlen
+}
+
+// validRecord reports whether b starts with a complete
+// record whose checksum matches
+func validRecord(b []byte) bool {
+	if len(b) < recordHeaderLen {
+		return false
+	}
+	klen, vlen := recordLengths(b)
+	end := recordHeaderLen + klen + vlen
+	if end > uint64(len(b)) {
+		return false
+	}
+	return crc32.Checksum(b[4:end], crcTable) == binary.LittleEndian.Uint32(b[0:4])
+}
+
+// decode verifies the checksum of a complete record and fills in
+// the fields of d from it
+func (d *DataRecord) decode(data []byte, klen uint64) error {
+	if crc32.Checksum(data[4:], crcTable) != binary.LittleEndian.Uint32(data[0:4]) {
+		return ErrBadChecksum
+	}
+	d.Kind = data[4]
+	if d.Kind != typeAdd && d.Kind != typePut && d.Kind != typeDel && d.Kind != typeBatch {
+		return ErrBadRecord
+	}
+	d.Seq = binary.LittleEndian.Uint64(data[5:13])
+	d.Key = string(data[recordHeaderLen : recordHeaderLen+klen])
+	d.Value = data[recordHeaderLen+klen:]
+	if d.Kind == typeBatch {
+		// make sure the whole batch can be applied
+		// before anything in it is
+		_, err := readBatch(d.Value, d.Seq)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
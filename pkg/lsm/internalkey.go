@@ -0,0 +1,86 @@
+package lsm
+
+import "encoding/binary"
+
+// Every write is given a sequence number, one higher than the write
+// before it, and is stored in the memtable and in sstables under an
+// internal key made up of the user key, the sequence number and the
+// kind of the write, so that several versions of a key can be held
+// at once:
+//
+//	escaped user key | 0x00 0x01 | ^(seq<<8 | kind) u64 big endian
+//
+// The user key is escaped by writing every 0x00 byte as 0x00 0xff,
+// which keeps the order of user keys and means the 0x00 0x01
+// terminator sorts before anything that can follow it in a longer
+// key. Inverting the trailer makes newer versions sort first, so
+// internal keys can be compared as plain strings: by user key, and
+// then newest version first.
+
+const (
+	// maxSequence is the highest sequence number an internal key
+	// can hold. Reading as of maxSequence sees every write.
+	maxSequence = 1<<56 - 1
+
+	// kindSeek is used in keys that are only sought, never stored.
+	// It sorts before every real kind with the same sequence number.
+	kindSeek = 0xff
+
+	internalTrailerLen = 10
+)
+
+// makeInternalKey returns the internal key for a version of key
+func makeInternalKey(key string, seq uint64, kind byte) string {
+	b := make([]byte, 0, len(key)+internalTrailerLen)
+	for i := 0; i < len(key); i++ {
+		b = append(b, key[i])
+		if key[i] == 0x00 {
+			b = append(b, 0xff)
+		}
+	}
+	b = append(b, 0x00, 0x01)
+	b = binary.BigEndian.AppendUint64(b, ^(seq<<8 | uint64(kind)))
+	return string(b)
+}
+
+// seekKey returns the internal key sorting before every version of
+// key that is visible as of seq, and after every version that is not
+func seekKey(key string, seq uint64) string {
+	return makeInternalKey(key, seq, kindSeek)
+}
+
+// parseInternalKey splits an internal key back into its parts
+func parseInternalKey(ikey string) (string, uint64, byte, error) {
+	n := len(ikey) - internalTrailerLen
+	if n < 0 || ikey[n] != 0x00 || ikey[n+1] != 0x01 {
+		return "", 0, 0, ErrCorrupt
+	}
+	trailer := ^binary.BigEndian.Uint64([]byte(ikey[n+2:]))
+	key := ikey[:n]
+	for i := 0; i < len(key); i++ {
+		if key[i] == 0x00 {
+			key = unescapeKey(key)
+			break
+		}
+	}
+	if key == "" && n > 0 {
+		return "", 0, 0, ErrCorrupt
+	}
+	return key, trailer >> 8, byte(trailer), nil
+}
+
+// unescapeKey undoes the escaping of the user key in an internal key,
+// returning "" if it is malformed
+func unescapeKey(key string) string {
+	b := make([]byte, 0, len(key))
+	for i := 0; i < len(key); i++ {
+		b = append(b, key[i])
+		if key[i] == 0x00 {
+			if i+1 >= len(key) || key[i+1] != 0xff {
+				return ""
+			}
+			i++
+		}
+	}
+	return string(b)
+}
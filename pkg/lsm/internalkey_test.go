@@ -0,0 +1,51 @@
+package lsm
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestInternalKey(t *testing.T) {
+	type version struct {
+		key  string
+		seq  uint64
+		kind byte
+	}
+	// in the order their internal keys must sort
+	want := []version{
+		{"", 7, typePut},
+		{"a", 9, typeDel},
+		{"a", 3, typePut},
+		{"a", 0, typePut},
+		{"a\x00", 5, typePut},
+		{"a\x00\x00", 1, typePut},
+		{"a\x00\x01", 2, typeDel},
+		{"a\x01", 8, typePut},
+		{"ab", maxSequence, typePut},
+		{"ab", 4, typePut},
+		{"b\xff", 6, typePut},
+	}
+	keys := make([]string, len(want))
+	for i, v := range want {
+		keys[len(want)-1-i] = makeInternalKey(v.key, v.seq, v.kind)
+	}
+	sort.Strings(keys)
+	for i, ikey := range keys {
+		key, seq, kind, err := parseInternalKey(ikey)
+		if err != nil {
+			t.Fatalf("parse %q: %v", ikey, err)
+		}
+		if got := (version{key, seq, kind}); got != want[i] {
+			t.Fatalf("key %d: got %+v, want %+v", i, got, want[i])
+		}
+	}
+	// a seek key sorts before every visible version and after the rest
+	if s := seekKey("a", 3); s >= keys[2] || s <= keys[1] {
+		t.Errorf("seek key for a as of 3 out of place")
+	}
+	for _, bad := range []string{"", "a", "a\x00\x02\x00\x00\x00\x00\x00\x00\x00\x00", "a\x00b\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00"} {
+		if _, _, _, err := parseInternalKey(bad); err != ErrCorrupt {
+			t.Errorf("parse %q: got %v, want %v", bad, err, ErrCorrupt)
+		}
+	}
+}
@@ -0,0 +1,498 @@
+package lsm
+
+import (
+	"container/heap"
+	"sort"
+
+	"github.com/scottcagno/lsmt/pkg/lsm/rbtree"
+)
+
+// iterator is a cursor over a sorted generation of data. Entries are
+// ordered by key, and versions of the same key by sequence number,
+// newest first, no two of them sharing both key and sequence number.
+// It moves forward with next once positioned by seek, and backward
+// with prev once positioned by seekLT or last; changing direction
+// takes a new seek.
+type iterator interface {
+	// seek positions the iterator at the newest version of
+	// the first key greater than or equal to key
+	seek(key string)
+	// seekLT positions the iterator at the oldest
+	// version of the last key less than key
+	seekLT(key string)
+	// last positions the iterator at the
+	// oldest version of the last key
+	last()
+	valid() bool
+	next()
+	prev()
+	key() string
+	seq() uint64
+	kind() byte
+	value() []byte
+	err() error
+}
+
+// memIterator walks the red black tree of a memtable in place. It
+// takes the read lock of the memtable for every step, so writes carry
+// on around it; those made after it was created can be hidden by
+// reading as of a sequence number, see visibleIterator.
+type memIterator struct {
+	m    *Memtable
+	data *rbtree.RBTree
+	ikey string // internal key of the current entry
+	cur  item
+	ok   bool
+}
+
+func (it *memIterator) set(ikey string, val []byte, ok bool) {
+	it.ikey, it.ok = ikey, ok
+	if ok {
+		it.cur = decodeEntry(ikey, val)
+	}
+}
+
+func (it *memIterator) seek(key string) {
+	it.m.mu.RLock()
+	defer it.m.mu.RUnlock()
+	it.set(it.data.Ceil(seekKey(key, maxSequence)))
+}
+
+func (it *memIterator) seekLT(key string) {
+	it.m.mu.RLock()
+	defer it.m.mu.RUnlock()
+	it.set(it.data.Prev(seekKey(key, maxSequence)))
+}
+
+func (it *memIterator) last() {
+	it.m.mu.RLock()
+	defer it.m.mu.RUnlock()
+	it.set(it.data.Max())
+}
+
+func (it *memIterator) next() {
+	it.m.mu.RLock()
+	defer it.m.mu.RUnlock()
+	// nothing sorts between an internal key and itself plus a zero byte
+	it.set(it.data.Ceil(it.ikey + "\x00"))
+}
+
+func (it *memIterator) prev() {
+	it.m.mu.RLock()
+	defer it.m.mu.RUnlock()
+	it.set(it.data.Prev(it.ikey))
+}
+
+func (it *memIterator) valid() bool   { return it.ok }
+func (it *memIterator) key() string   { return it.cur.key }
+func (it *memIterator) seq() uint64   { return it.cur.seq }
+func (it *memIterator) kind() byte    { return it.cur.kind }
+func (it *memIterator) value() []byte { return it.cur.val }
+func (it *memIterator) err() error    { return nil }
+
+// tableIterator iterates over an sstable one data block at a time
+type tableIterator struct {
+	r     *SSTableReader
+	block int    // index of the loaded data block
+	ents  []item // decoded entries of the loaded data block
+	pos   int
+	e     error
+}
+
+func (it *tableIterator) seek(key string) {
+	target := seekKey(key, maxSequence)
+	it.block = sort.Search(len(it.r.index), func(i int) bool {
+		return it.r.index[i].lastKey >= target
+	})
+	it.load()
+	it.pos = sort.Search(len(it.ents), func(i int) bool {
+		return it.ents[i].key >= key
+	})
+}
+
+func (it *tableIterator) seekLT(key string) {
+	// a seek past the last key leaves the iterator
+	// after the last block, from where prev goes back
+	it.seek(key)
+	it.prev()
+}
+
+func (it *tableIterator) last() {
+	it.block = len(it.r.index) - 1
+	it.load()
+	it.pos = len(it.ents) - 1
+}
+
+func (it *tableIterator) load() {
+	it.ents, it.pos = nil, 0
+	if it.block < 0 || it.block >= len(it.r.index) {
+		return
+	}
+	it.ents, it.e = it.r.readEntries(it.block)
+}
+
+func (it *tableIterator) valid() bool {
+	return it.e == nil && it.pos >= 0 && it.pos < len(it.ents)
+}
+
+func (it *tableIterator) next() {
+	it.pos++
+	if it.pos >= len(it.ents) {
+		it.block++
+		it.load()
+	}
+}
+
+func (it *tableIterator) prev() {
+	it.pos--
+	if it.pos < 0 && it.block > 0 {
+		it.block--
+		it.load()
+		it.pos = len(it.ents) - 1
+	}
+}
+
+func (it *tableIterator) key() string   { return it.ents[it.pos].key }
+func (it *tableIterator) seq() uint64   { return it.ents[it.pos].seq }
+func (it *tableIterator) kind() byte    { return it.ents[it.pos].kind }
+func (it *tableIterator) value() []byte { return it.r.owned(it.ents[it.pos].val) }
+func (it *tableIterator) err() error    { return it.e }
+
+// mergeIterator merges several iterators into a single sorted
+// view holding every version from each of them. The iterators are
+// kept in a heap ordered by their current entries, the other way
+// round when going backward. Every write has a sequence number of
+// its own, so no two of them hold the same version of a key.
+type mergeIterator struct {
+	iters []iterator
+	h     mergeHeap
+}
+
+func newMergeIterator(iters []iterator) *mergeIterator {
+	return &mergeIterator{iters: iters, h: mergeHeap{iters: iters}}
+}
+
+// mergeHeap is a heap of the indexes of the valid iterators
+type mergeHeap struct {
+	iters []iterator
+	idx   []int
+	rev   bool
+}
+
+func (h *mergeHeap) Len() int      { return len(h.idx) }
+func (h *mergeHeap) Swap(i, j int) { h.idx[i], h.idx[j] = h.idx[j], h.idx[i] }
+func (h *mergeHeap) Push(x any)    { h.idx = append(h.idx, x.(int)) }
+
+func (h *mergeHeap) Pop() any {
+	i := h.idx[len(h.idx)-1]
+	h.idx = h.idx[:len(h.idx)-1]
+	return i
+}
+
+func (h *mergeHeap) Less(i, j int) bool {
+	a, b := h.iters[h.idx[i]], h.iters[h.idx[j]]
+	if a.key() != b.key() {
+		return a.key() < b.key() != h.rev
+	}
+	return a.seq() > b.seq() != h.rev
+}
+
+// init rebuilds the heap once every iterator has been positioned
+func (m *mergeIterator) init(rev bool) {
+	m.h.rev = rev
+	m.h.idx = m.h.idx[:0]
+	for i, it := range m.iters {
+		if it.valid() {
+			m.h.idx = append(m.h.idx, i)
+		}
+	}
+	heap.Init(&m.h)
+}
+
+func (m *mergeIterator) seek(key string) {
+	for _, it := range m.iters {
+		it.seek(key)
+	}
+	m.init(false)
+}
+
+func (m *mergeIterator) seekLT(key string) {
+	for _, it := range m.iters {
+		it.seekLT(key)
+	}
+	m.init(true)
+}
+
+func (m *mergeIterator) last() {
+	for _, it := range m.iters {
+		it.last()
+	}
+	m.init(true)
+}
+
+func (m *mergeIterator) valid() bool {
+	return len(m.h.idx) > 0 && m.err() == nil
+}
+
+func (m *mergeIterator) next() { m.step((iterator).next) }
+func (m *mergeIterator) prev() { m.step((iterator).prev) }
+
+// step moves the iterator holding the current
+// version past it, in the direction of move
+func (m *mergeIterator) step(move func(iterator)) {
+	it := m.top()
+	move(it)
+	if it.valid() {
+		heap.Fix(&m.h, 0)
+	} else {
+		heap.Pop(&m.h)
+	}
+}
+
+func (m *mergeIterator) top() iterator { return m.iters[m.h.idx[0]] }
+func (m *mergeIterator) key() string   { return m.top().key() }
+func (m *mergeIterator) seq() uint64   { return m.top().seq() }
+func (m *mergeIterator) kind() byte    { return m.top().kind() }
+func (m *mergeIterator) value() []byte { return m.top().value() }
+
+func (m *mergeIterator) err() error {
+	for _, it := range m.iters {
+		if err := it.err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// visibleIterator shows the data of another iterator as it was as
+// of a sequence number: versions written after seq are skipped, only
+// the newest version left of each key is shown, and keys whose
+// newest version left is a tombstone, or is older than a range delete
+// in dels covering the key, are hidden. Going backward the versions of
+// a key are met oldest first, so the one to show is only known once
+// they have all been passed, and is kept in cur. Only keys from
+// lower up to, but not including, upper are shown, an empty upper
+// meaning no bound, and nothing outside them is read past.
+type visibleIterator struct {
+	it    iterator
+	max   uint64
+	dels  *rangeDelSet // may be nil
+	lower string
+	upper string
+	rev   bool // moving backward
+	cur   item // entry shown when moving backward
+	ok    bool // whether there is one
+}
+
+func newVisibleIterator(it iterator, seq uint64, dels *rangeDelSet) *visibleIterator {
+	return &visibleIterator{it: it, max: seq, dels: dels}
+}
+
+func (v *visibleIterator) seek(key string) {
+	if key < v.lower {
+		key = v.lower
+	}
+	v.rev = false
+	v.it.seek(key)
+	v.settle()
+}
+
+func (v *visibleIterator) seekLT(key string) {
+	if v.upper != "" && key > v.upper {
+		key = v.upper
+	}
+	v.rev = true
+	v.it.seekLT(key)
+	v.settleBack()
+}
+
+func (v *visibleIterator) last() {
+	if v.upper != "" {
+		v.seekLT(v.upper)
+		return
+	}
+	v.rev = true
+	v.it.last()
+	v.settleBack()
+}
+
+func (v *visibleIterator) valid() bool {
+	if v.rev {
+		return v.ok
+	}
+	return v.it.valid() && (v.upper == "" || v.it.key() < v.upper)
+}
+
+func (v *visibleIterator) next() {
+	v.skipKey()
+	v.settle()
+}
+
+// prev moves to the previous key shown. The underlying
+// iterator is already past the versions of the current one.
+func (v *visibleIterator) prev() {
+	v.settleBack()
+}
+
+// settle moves forward to the first entry that should be shown,
+// starting from the current one
+func (v *visibleIterator) settle() {
+	for v.it.valid() {
+		if v.upper != "" && v.it.key() >= v.upper {
+			return
+		}
+		if v.it.seq() > v.max {
+			v.it.next()
+			continue
+		}
+		if v.shown(v.it.key(), v.it.seq(), v.it.kind()) {
+			return
+		}
+		v.skipKey()
+	}
+}
+
+// settleBack moves backward to the last key that should be shown,
+// starting from the current entry, leaving the underlying iterator
+// on the entry before its versions
+func (v *visibleIterator) settleBack() {
+	v.ok = false
+	for v.it.valid() {
+		k := v.it.key()
+		if k < v.lower {
+			return
+		}
+		found := false
+		for ; v.it.valid() && v.it.key() == k; v.it.prev() {
+			if v.it.seq() <= v.max {
+				v.cur = item{key: k, seq: v.it.seq(), kind: v.it.kind(), val: v.it.value()}
+				found = true
+			}
+		}
+		if found && v.shown(k, v.cur.seq, v.cur.kind) {
+			v.ok = true
+			return
+		}
+	}
+}
+
+// shown reports whether the newest version left of key is shown
+func (v *visibleIterator) shown(key string, seq uint64, kind byte) bool {
+	return kind != typeDel && v.dels.covering(key) <= seq
+}
+
+// skipKey moves past every version left of the current key
+func (v *visibleIterator) skipKey() {
+	k := v.it.key()
+	for v.it.next(); v.it.valid() && v.it.key() == k; v.it.next() {
+	}
+}
+
+func (v *visibleIterator) key() string {
+	if v.rev {
+		return v.cur.key
+	}
+	return v.it.key()
+}
+
+func (v *visibleIterator) seq() uint64 {
+	if v.rev {
+		return v.cur.seq
+	}
+	return v.it.seq()
+}
+
+func (v *visibleIterator) kind() byte {
+	if v.rev {
+		return v.cur.kind
+	}
+	return v.it.kind()
+}
+
+func (v *visibleIterator) value() []byte {
+	if v.rev {
+		return v.cur.val
+	}
+	return v.it.value()
+}
+
+func (v *visibleIterator) err() error { return v.it.err() }
+
+// dbIterator is the Iterator handed out for a tree, a memtable or
+// an sstable, showing the entries of a visibleIterator. It steps at
+// the granularity of keys, so it can turn around by seeking to the
+// key it is on.
+type dbIterator struct {
+	v       *visibleIterator // nil once closed
+	release func()           // releases what v reads from, may be nil
+	e       error
+}
+
+func (it *dbIterator) SeekGE(key string) {
+	if it.v != nil {
+		it.v.seek(key)
+	}
+}
+
+func (it *dbIterator) SeekLT(key string) {
+	if it.v != nil {
+		it.v.seekLT(key)
+	}
+}
+
+func (it *dbIterator) First() { it.SeekGE("") }
+
+func (it *dbIterator) Last() {
+	if it.v != nil {
+		it.v.last()
+	}
+}
+
+func (it *dbIterator) Next() {
+	if !it.Valid() {
+		return
+	}
+	if it.v.rev {
+		k := it.v.key()
+		it.v.seek(k)
+		if !it.v.valid() || it.v.key() != k {
+			return
+		}
+	}
+	it.v.next()
+}
+
+func (it *dbIterator) Prev() {
+	if !it.Valid() {
+		return
+	}
+	if !it.v.rev {
+		it.v.seekLT(it.v.key())
+		return
+	}
+	it.v.prev()
+}
+
+func (it *dbIterator) Valid() bool {
+	return it.v != nil && it.v.valid()
+}
+
+func (it *dbIterator) Key() string   { return it.v.key() }
+func (it *dbIterator) Value() []byte { return it.v.value() }
+
+func (it *dbIterator) Err() error {
+	if it.e == nil && it.v != nil {
+		return it.v.err()
+	}
+	return it.e
+}
+
+func (it *dbIterator) Close() error {
+	err := it.Err()
+	it.v = nil
+	if it.release != nil {
+		it.release()
+		it.release = nil
+	}
+	return err
+}
@@ -0,0 +1,248 @@
+package lsm
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// checkIterator walks it forward and backward, and then at random
+// over the first n keys, checking it against want at every step
+func checkIterator(t *testing.T, it Iterator, n int, want map[string][]byte) {
+	t.Helper()
+	keys := make([]string, 0, len(want))
+	for k := range want {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pos := -1
+	check := func(op string) {
+		t.Helper()
+		if pos < 0 || pos >= len(keys) {
+			if it.Valid() {
+				t.Fatalf("%s: got %q, want invalid", op, it.Key())
+			}
+			return
+		}
+		if !it.Valid() {
+			t.Fatalf("%s: got invalid (%v), want %q", op, it.Err(), keys[pos])
+		}
+		if it.Key() != keys[pos] || !bytes.Equal(it.Value(), want[keys[pos]]) {
+			t.Fatalf("%s: got %q=%q, want %q=%q", op, it.Key(), it.Value(), keys[pos], want[keys[pos]])
+		}
+	}
+	var count int
+	for it.First(); it.Valid(); it.Next() {
+		count++
+	}
+	if count != len(keys) {
+		t.Fatalf("forward: got %d entries, want %d", count, len(keys))
+	}
+	count = 0
+	for it.Last(); it.Valid(); it.Prev() {
+		count++
+	}
+	if count != len(keys) {
+		t.Fatalf("backward: got %d entries, want %d", count, len(keys))
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		k := makeKey(rnd.Intn(n))
+		switch op := rnd.Intn(6); op {
+		case 0:
+			it.SeekGE(k)
+			pos = sort.SearchStrings(keys, k)
+			check("seek ge " + k)
+		case 1:
+			it.SeekLT(k)
+			pos = sort.SearchStrings(keys, k) - 1
+			check("seek lt " + k)
+		case 2:
+			it.First()
+			pos = 0
+			check("first")
+		case 3:
+			it.Last()
+			pos = len(keys) - 1
+			check("last")
+		default:
+			// a few steps in one direction, then back
+			for j := rnd.Intn(10); j > 0 && pos >= 0 && pos < len(keys); j-- {
+				if op == 4 {
+					it.Next()
+					pos++
+				} else {
+					it.Prev()
+					pos--
+				}
+				check(fmt.Sprintf("step %d", op))
+			}
+		}
+	}
+	if err := it.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+}
+
+func TestIterator_SSTable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "000001.sst")
+	writeTestTable(t, path, 500)
+	r, err := OpenSSTableReader(path, nil)
+	if err != nil {
+		t.Fatalf("open reader: %v", err)
+	}
+	defer r.Close()
+	want := make(map[string][]byte)
+	for i := 0; i < 500; i++ {
+		want[makeKey(i)] = makeVal(i)
+	}
+	checkIterator(t, r.NewIterator(nil), 600, want)
+}
+
+func TestIterator_Memtable(t *testing.T) {
+	mem, err := NewMemtable(filepath.Join(t.TempDir(), "wal.log"), false)
+	if err != nil {
+		t.Fatalf("new memtable: %v", err)
+	}
+	defer mem.Close()
+	want := make(map[string][]byte)
+	for i := 0; i < 300; i++ {
+		mem.Put(makeKey(i), makeVal(i))
+		want[makeKey(i)] = makeVal(i)
+	}
+	for i := 0; i < 300; i += 3 {
+		mem.Del(makeKey(i))
+		delete(want, makeKey(i))
+	}
+	for i := 1; i < 300; i += 3 {
+		mem.Put(makeKey(i), []byte("new"))
+		want[makeKey(i)] = []byte("new")
+	}
+	it := mem.NewIterator(nil)
+	// writes made after it was created are not seen
+	mem.Put(makeKey(2), []byte("later"))
+	mem.Put("later", nil)
+	checkIterator(t, it, 400, want)
+}
+
+func TestLSMTree_Iterator(t *testing.T) {
+	db := openCompactionTestTree(t, t.TempDir())
+	defer db.Close()
+	rnd := rand.New(rand.NewSource(1))
+	want := make(map[string][]byte)
+	for i := 0; i < 5000; i++ {
+		k := makeKey(rnd.Intn(1000))
+		switch rnd.Intn(10) {
+		case 0:
+			db.Del(k)
+			delete(want, k)
+		case 1:
+			if rnd.Intn(20) == 0 {
+				lo := rnd.Intn(1000)
+				hi := lo + rnd.Intn(50)
+				var b WriteBatch
+				b.DelRange(makeKey(lo), makeKey(hi))
+				db.Write(&b)
+				for j := lo; j < hi; j++ {
+					delete(want, makeKey(j))
+				}
+			}
+		default:
+			v := []byte(fmt.Sprintf("%s-%d", k, i))
+			db.Put(k, v)
+			want[k] = v
+		}
+	}
+	it := db.NewIterator(nil)
+	// the tree can be written to, flushed and compacted
+	// while the iterator carries on with what it saw
+	for i := 0; i < 1000; i++ {
+		if err := db.Put(makeKey(i), []byte("later")); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	checkIterator(t, it, 1100, want)
+}
+
+func TestIterOptions_Bounds(t *testing.T) {
+	for _, tc := range []struct {
+		opts         *IterOptions
+		lower, upper string
+	}{
+		{nil, "", ""},
+		{&IterOptions{LowerBound: "b", UpperBound: "d"}, "b", "d"},
+		{&IterOptions{Prefix: "ab"}, "ab", "ac"},
+		{&IterOptions{Prefix: "a\xff\xff"}, "a\xff\xff", "b"},
+		{&IterOptions{Prefix: "\xff"}, "\xff", ""},
+		{&IterOptions{Prefix: "b", LowerBound: "a", UpperBound: "b5"}, "b", "b5"},
+		{&IterOptions{Prefix: "b", LowerBound: "b5", UpperBound: "d"}, "b5", "c"},
+	} {
+		lower, upper := tc.opts.bounds()
+		if lower != tc.lower || upper != tc.upper {
+			t.Errorf("%+v: got %q to %q, want %q to %q", tc.opts, lower, upper, tc.lower, tc.upper)
+		}
+	}
+}
+
+func TestLSMTree_Scan(t *testing.T) {
+	db := openCompactionTestTree(t, t.TempDir())
+	defer db.Close()
+	want := make(map[string][]byte)
+	for i := 0; i < 3000; i++ {
+		db.Put(makeKey(i), makeVal(i))
+		want[makeKey(i)] = makeVal(i)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	bounded := func(lower, upper string) map[string][]byte {
+		m := make(map[string][]byte)
+		for k, v := range want {
+			if k >= lower && (upper == "" || k < upper) {
+				m[k] = v
+			}
+		}
+		return m
+	}
+
+	// only the tables holding keys in range are read
+	opts := &IterOptions{LowerBound: makeKey(1200), UpperBound: makeKey(1300)}
+	it := db.NewIterator(opts)
+	if n, total := len(it.(*dbIterator).v.it.(*mergeIterator).iters), len(db.live)+1; n >= total {
+		t.Fatalf("bounded iterator reads %d of %d sources", n, total)
+	}
+	checkIterator(t, it, 3100, bounded(opts.LowerBound, opts.UpperBound))
+	checkIterator(t, db.NewIterator(&IterOptions{LowerBound: makeKey(2900)}), 3100, bounded(makeKey(2900), ""))
+
+	var got []string
+	err := db.Scan(makeKey(10), makeKey(20), func(k string, v []byte) bool {
+		got = append(got, k)
+		return true
+	})
+	if err != nil || len(got) != 10 || got[0] != makeKey(10) || got[9] != makeKey(19) {
+		t.Fatalf("scan: got %q (%v)", got, err)
+	}
+	got = got[:0]
+	err = db.ScanPrefix(makeKey(25)[:len(makeKey(25))-1], func(k string, v []byte) bool {
+		got = append(got, k)
+		// the tree is not locked while scanning
+		return db.Put("x"+k, v) == nil
+	})
+	if err != nil || len(got) != 10 || got[0] != makeKey(20) || got[9] != makeKey(29) {
+		t.Fatalf("scan prefix: got %q (%v)", got, err)
+	}
+	got = got[:0]
+	err = db.ScanPrefix("x", func(k string, v []byte) bool {
+		got = append(got, k)
+		return len(got) < 5
+	})
+	if err != nil || len(got) != 5 || got[0] != "x"+makeKey(20) {
+		t.Fatalf("scan prefix: got %q (%v)", got, err)
+	}
+}
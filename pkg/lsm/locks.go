@@ -0,0 +1,121 @@
+package lsm
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrLockTimeout = errors.New("txn: timed out waiting for lock")
+	ErrDeadlock    = errors.New("txn: deadlock")
+)
+
+// lockTable holds the key locks of pessimistic transactions. Locks are
+// exclusive and are held until the transaction holding them commits or
+// rolls back. Every transaction waiting for a lock is recorded in a
+// wait-for graph, pointing at the transaction holding it. Since a
+// transaction waits for one lock at a time, the graph is a set of
+// chains, and a wait that would close one into a cycle is refused
+// with ErrDeadlock instead of being left to time out.
+type lockTable struct {
+	mu      sync.Mutex
+	locks   map[string]*keyLock
+	waitFor map[uint64]uint64 // waiting txn -> txn holding the lock it waits for
+	lastID  uint64
+}
+
+type keyLock struct {
+	owner    uint64
+	released chan struct{} // closed once the lock is released
+}
+
+func newLockTable() *lockTable {
+	return &lockTable{
+		locks:   make(map[string]*keyLock),
+		waitFor: make(map[uint64]uint64),
+	}
+}
+
+// newID returns an id for a new transaction
+func (lt *lockTable) newID() uint64 {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	lt.lastID++
+	return lt.lastID
+}
+
+// acquire locks key for txn id, waiting up to timeout for whoever
+// holds it to let go, or forever if timeout is negative. It reports
+// whether the lock was newly taken, it is not if id already held it.
+func (lt *lockTable) acquire(id uint64, key string, timeout time.Duration) (bool, error) {
+	var expired <-chan time.Time
+	if timeout >= 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	for {
+		l := lt.locks[key]
+		if l == nil {
+			lt.locks[key] = &keyLock{owner: id, released: make(chan struct{})}
+			return true, nil
+		}
+		if l.owner == id {
+			return false, nil
+		}
+		if lt.waitsFor(l.owner, id) {
+			return false, ErrDeadlock
+		}
+		lt.waitFor[id] = l.owner
+		lt.mu.Unlock()
+		var err error
+		select {
+		case <-l.released:
+		case <-expired:
+			err = ErrLockTimeout
+		}
+		lt.mu.Lock()
+		delete(lt.waitFor, id)
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// waitsFor reports whether txn from is waiting on txn to, directly
+// or through a chain of others. The caller must hold mu.
+func (lt *lockTable) waitsFor(from, to uint64) bool {
+	for id := from; ; {
+		if id == to {
+			return true
+		}
+		next, ok := lt.waitFor[id]
+		if !ok {
+			return false
+		}
+		id = next
+	}
+}
+
+// release releases the locks on keys held by txn id,
+// waking anyone waiting for them
+func (lt *lockTable) release(id uint64, keys []string) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	for _, key := range keys {
+		if l := lt.locks[key]; l != nil && l.owner == id {
+			delete(lt.locks, key)
+			close(l.released)
+		}
+	}
+	// whoever was waiting on it no longer is, so that a stale
+	// edge is not mistaken for a deadlock before they wake up
+	for waiter, owner := range lt.waitFor {
+		if owner == id {
+			delete(lt.waitFor, waiter)
+		}
+	}
+}
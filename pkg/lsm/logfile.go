@@ -1,20 +1,29 @@
 package lsm
 
 import (
-	"encoding/binary"
+	"bufio"
+	"bytes"
 	"fmt"
 	"io"
+	"log"
 	"os"
+	"sync"
+	"time"
 )
 
+// LogFile is an append only write ahead log of DataRecords
 type LogFile struct {
-	file *os.File
-	size int64
-}
-
-type entry struct {
-	key string
-	val string
+	mu       sync.Mutex
+	file     *os.File
+	path     string
+	size     int64
+	first    uint64        // sequence number of the first record
+	last     uint64        // sequence number of the last record
+	policy   SyncPolicy    // when writes are synced to disk
+	unsynced int64         // bytes written since the last sync
+	syncs    int64         // number of times the file has been synced
+	stop     chan struct{} // stops the interval syncer, if running
+	failed   error         // set if a failed write could not be undone
 }
 
 func OpenLogFile(path string) (*LogFile, error) {
@@ -28,122 +37,384 @@ func OpenLogFile(path string) (*LogFile, error) {
 	}
 	return &LogFile{
 		file: fd,
+		path: fd.Name(),
 		size: fi.Size(),
 	}, nil
 }
 
-func (l *LogFile) Append(data []byte) error {
-	_, err := l.file.Seek(0, io.SeekEnd)
-	if err != nil {
-		return fmt.Errorf("[LogFile.Write] seek: %v", err)
+// SyncMode selects when writes to a log are synced to disk
+type SyncMode int
+
+const (
+	// SyncAlways syncs the log before every write returns, so a
+	// write that succeeded survives a crash. Concurrent writers
+	// are grouped so they share a single sync. This is the default.
+	SyncAlways SyncMode = iota
+
+	// SyncInterval syncs the log in the background every
+	// SyncPolicy.Interval. Writes made since the last sync may be
+	// lost in a crash.
+	SyncInterval
+
+	// SyncBytes syncs the log once at least SyncPolicy.Bytes bytes
+	// have been written since the last sync.
+	SyncBytes
+
+	// SyncNever leaves syncing to the operating system, apart from
+	// when the log is closed.
+	SyncNever
+)
+
+func (m SyncMode) String() string {
+	switch m {
+	case SyncAlways:
+		return "always"
+	case SyncInterval:
+		return "interval"
+	case SyncBytes:
+		return "bytes"
+	case SyncNever:
+		return "never"
 	}
-	return nil
+	return fmt.Sprintf("SyncMode(%d)", int(m))
 }
 
-func (l *LogFile) WriteRecord(record *DataRecord) error {
-	data, err := record.MarshalBinary()
-	if err != nil {
-		return err
+// SyncPolicy controls how often a log is synced to disk
+type SyncPolicy struct {
+	Mode     SyncMode
+	Interval time.Duration // used by SyncInterval
+	Bytes    int64         // used by SyncBytes
+}
+
+var DefaultSyncPolicy = SyncPolicy{
+	Mode:     SyncAlways,
+	Interval: 100 * time.Millisecond,
+	Bytes:    1 << 20,
+}
+
+// SetSyncPolicy changes when the log is synced to disk, starting or
+// stopping the background syncer as needed. A zero Interval or Bytes
+// is replaced by the matching value from DefaultSyncPolicy.
+func (l *LogFile) SetSyncPolicy(p SyncPolicy) {
+	if p.Interval <= 0 {
+		p.Interval = DefaultSyncPolicy.Interval
 	}
-	_, err = l.file.Write(data)
-	if err != nil {
-		return err
+	if p.Bytes <= 0 {
+		p.Bytes = DefaultSyncPolicy.Bytes
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stop != nil {
+		close(l.stop)
+		l.stop = nil
+	}
+	l.policy = p
+	if p.Mode == SyncInterval && l.file != nil {
+		l.stop = make(chan struct{})
+		go l.syncEvery(p.Interval, l.stop)
 	}
-	return nil
 }
 
-func (l *LogFile) ReadRecord() (*DataRecord, error) {
-	head := make([]byte, 8)
-	_, err := l.file.Read(head)
-	if err != nil {
-		return nil, err
+// syncEvery syncs the log every d until stop is closed
+func (l *LogFile) syncEvery(d time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			l.mu.Lock()
+			if l.file != nil && l.unsynced > 0 {
+				if err := l.sync(); err != nil {
+					log.Printf("Failed to sync %s: %v\n", l.path, err)
+				}
+			}
+			l.mu.Unlock()
+		}
+	}
+}
+
+// WriteRecord appends a record to the log, syncing it to disk
+// according to the sync policy
+func (l *LogFile) WriteRecord(rec *DataRecord) error {
+	return l.WriteRecords([]*DataRecord{rec})
+}
+
+// WriteRecords appends a group of records to the log with a single
+// write, followed by at most one sync according to the sync policy.
+// With SyncAlways every record is on disk once it returns. If the
+// write or the sync fails, none of the group is left in the log.
+func (l *LogFile) WriteRecords(recs []*DataRecord) error {
+	var buf bytes.Buffer
+	for _, rec := range recs {
+		_, err := writeRecord(&buf, rec)
+		if err != nil {
+			return fmt.Errorf("[LogFile.WriteRecords] calling writeRecord: %v", err)
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return fmt.Errorf("[LogFile.WriteRecords] %s: %v", l.path, os.ErrClosed)
+	}
+	if l.failed != nil {
+		return fmt.Errorf("[LogFile.WriteRecords] %s failed earlier: %v", l.path, l.failed)
 	}
-	rlen := binary.LittleEndian.Uint64(head)
-	data := make([]byte, rlen)
-	_, err = l.file.Read(data)
+	start := l.size
+	n, err := l.file.Write(buf.Bytes())
 	if err != nil {
-		return nil, err
+		l.undo(start, err)
+		return fmt.Errorf("[LogFile.WriteRecords] calling file.Write: %v", err)
+	}
+	l.size += int64(n)
+	l.unsynced += int64(n)
+	switch l.policy.Mode {
+	case SyncAlways:
+		err = l.sync()
+	case SyncBytes:
+		if l.unsynced >= l.policy.Bytes {
+			err = l.sync()
+		}
 	}
-	record := new(DataRecord)
-	err = record.UnmarshalBinary(data)
 	if err != nil {
-		return nil, err
+		l.undo(start, err)
+		return fmt.Errorf("[LogFile.WriteRecords] calling sync: %v", err)
+	}
+	for _, rec := range recs {
+		l.track(rec.Seq, rec.lastSeq())
 	}
-	return record, nil
+	return nil
 }
 
-func (l *LogFile) WriteAdd(key string, value []byte) error {
-	err := l.write(key, value)
+// undo cuts the log back to size after a write or sync of a group
+// failed with cause, so that records which were never acknowledged
+// are not replayed, and later ones are not appended after a torn one
+// and lost along with it. If the log can not be cut every later write
+// fails. The caller must hold the lock.
+func (l *LogFile) undo(size int64, cause error) {
+	err := l.file.Truncate(size)
 	if err != nil {
-		return fmt.Errorf("[LogFile.WriteAdd] calling write: %v", err)
+		l.failed = cause
+		return
 	}
-	return nil
+	l.unsynced -= l.size - size
+	l.size = size
 }
 
-func (l *LogFile) WritePut(key string, value []byte) error {
-	err := l.write(key, value)
-	if err != nil {
-		return fmt.Errorf("[LogFile.WritePut] calling write: %v", err)
+// Sync forces everything written to the log so far to disk
+func (l *LogFile) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil || l.unsynced == 0 {
+		return nil
 	}
-	return nil
+	return l.sync()
 }
 
-func (l *LogFile) WriteDel(key string) error {
-	err := l.write(key, nil)
+// sync syncs the file, the caller must hold the lock
+func (l *LogFile) sync() error {
+	err := l.file.Sync()
 	if err != nil {
-		return fmt.Errorf("[LogFile.WriteDel] calling write: %v", err)
+		return err
 	}
+	l.unsynced = 0
+	l.syncs++
 	return nil
 }
 
-func (l *LogFile) WriteEntry(e *entry) error {
-	err := l.write(e.key, []byte(e.val))
-	if err != nil {
-		return fmt.Errorf("[LogFile.WriteEntry] calling write: %v", err)
+// RecoveryMode controls what Replay does when it finds a record that
+// is corrupt, i.e. one that fails its checksum or whose lengths claim
+// it runs past the end of the log while a good record follows it. A
+// record that is cut short at the very end of the log, with nothing
+// good after it, is the normal result of a crash part way through a
+// write and is always truncated away, whatever the mode.
+type RecoveryMode int
+
+const (
+	// RecoverTruncate stops replaying at the first corrupt record
+	// and truncates the log there, dropping it and everything
+	// after it. This is the default.
+	RecoverTruncate RecoveryMode = iota
+
+	// RecoverFail stops replaying at the first corrupt record and
+	// returns an error, leaving the log untouched.
+	RecoverFail
+
+	// RecoverSkip skips over corrupt records, reporting their
+	// offsets, and carries on replaying the rest of the log. If the
+	// lengths in a corrupt record can not be trusted, replay carries
+	// on from the next record that checks out.
+	RecoverSkip
+)
+
+func (m RecoveryMode) String() string {
+	switch m {
+	case RecoverTruncate:
+		return "truncate"
+	case RecoverFail:
+		return "fail"
+	case RecoverSkip:
+		return "skip"
 	}
-	return nil
+	return fmt.Sprintf("RecoveryMode(%d)", int(m))
 }
 
-func (l *LogFile) ReadEntry(e *entry) error {
-	key, val, err := l.read()
+// ReplayReport describes the outcome of replaying a log
+type ReplayReport struct {
+	Records   int     // records passed to the replay callback
+	Skipped   []int64 // offsets of corrupt records that were skipped
+	Truncated int64   // number of bytes cut from the end of the log
+	Stopped   bool    // replay stopped short of the end of the log
+}
+
+// Replay reads every record in the log from the beginning and calls
+// fn with each one in order. Corrupt records are dealt with according
+// to mode. When replay stops early the log is truncated at that point,
+// so that new records are appended after the last good one.
+func (l *LogFile) Replay(mode RecoveryMode, fn func(rec *DataRecord) error) (*ReplayReport, error) {
+	report := new(ReplayReport)
+	_, err := l.file.Seek(0, io.SeekStart)
 	if err != nil {
+		return report, fmt.Errorf("[LogFile.Replay] seek: %v", err)
+	}
+	br := bufio.NewReader(l.file)
+	var off int64
+	for {
+		rec, n, err := readRecord(br, l.size-off)
 		if err == io.EOF {
-			return err
+			return report, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			// only torn if nothing that checks out comes after it,
+			// otherwise the lengths in its header are corrupt
+			next, ferr := l.findRecord(off + 1)
+			if ferr != nil {
+				return report, fmt.Errorf("[LogFile.Replay] calling findRecord: %v", ferr)
+			}
+			if next < 0 {
+				log.Printf("Truncating torn record at offset %d of %s\n", off, l.file.Name())
+				report.Truncated = l.size - off
+				report.Stopped = true
+				return report, l.truncate(off)
+			}
+			err = ErrBadRecord
+			if mode == RecoverSkip {
+				// carry on from the next record
+				_, serr := l.file.Seek(next, io.SeekStart)
+				if serr != nil {
+					return report, fmt.Errorf("[LogFile.Replay] seek: %v", serr)
+				}
+				br.Reset(l.file)
+				n = int(next - off)
+			}
+		}
+		if err == ErrBadChecksum || err == ErrBadRecord {
+			switch mode {
+			case RecoverFail:
+				return report, fmt.Errorf("[LogFile.Replay] record at offset %d: %w", off, err)
+			case RecoverSkip:
+				log.Printf("Skipping corrupt record at offset %d of %s: %v\n", off, l.file.Name(), err)
+				report.Skipped = append(report.Skipped, off)
+				off += int64(n)
+				continue
+			default:
+				log.Printf("Truncating at corrupt record at offset %d of %s: %v\n", off, l.file.Name(), err)
+				report.Truncated = l.size - off
+				report.Stopped = true
+				return report, l.truncate(off)
+			}
+		}
+		if err != nil {
+			return report, fmt.Errorf("[LogFile.Replay] reading record at offset %d: %v", off, err)
+		}
+		off += int64(n)
+		report.Records++
+		l.track(rec.Seq, rec.lastSeq())
+		err = fn(rec)
+		if err != nil {
+			return report, err
 		}
-		return fmt.Errorf("[LogFile.ReadEntry] calling read: %v", err)
 	}
-	e.key = key
-	e.val = string(val)
-	return nil
 }
 
-func (l *LogFile) Close() error {
-	err := l.file.Sync()
-	if err != nil {
-		return fmt.Errorf("[LogFile.Close] calling file.Sync: %v", err)
+// findRecord returns the offset of the first complete record with a
+// good checksum starting at or after off, or -1 if there is none
+func (l *LogFile) findRecord(off int64) (int64, error) {
+	if off >= l.size {
+		return -1, nil
 	}
-	err = l.file.Close()
+	b := make([]byte, l.size-off)
+	_, err := l.file.ReadAt(b, off)
 	if err != nil {
-		return fmt.Errorf("[LogFile.Close] calling file.Close: %v", err)
+		return -1, err
 	}
-	return nil
+	for i := 0; i+recordHeaderLen <= len(b); i++ {
+		if validRecord(b[i:]) {
+			return off + int64(i), nil
+		}
+	}
+	return -1, nil
 }
 
-func (l *LogFile) read() (string, []byte, error) {
-	key, val, err := readEntry(l.file)
+// track widens the sequence range covered by the log to include
+// the range from first to last
+func (l *LogFile) track(first, last uint64) {
+	if l.first == 0 || first < l.first {
+		l.first = first
+	}
+	if last > l.last {
+		l.last = last
+	}
+}
+
+// SeqRange returns the first and last sequence numbers written to
+// or replayed from the log. Both are zero if the log is empty.
+func (l *LogFile) SeqRange() (uint64, uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.first, l.last
+}
+
+// Name returns the path of the underlying file
+func (l *LogFile) Name() string {
+	return l.path
+}
+
+func (l *LogFile) truncate(size int64) error {
+	err := l.file.Truncate(size)
 	if err != nil {
-		if err == io.EOF {
-			return key, val, err
-		}
-		return key, val, fmt.Errorf("[LogFile.read] calling readEntry: %v", err)
+		return fmt.Errorf("[LogFile.truncate] calling file.Truncate: %v", err)
 	}
-	return key, val, err
+	l.size = size
+	err = l.file.Sync()
+	if err != nil {
+		return fmt.Errorf("[LogFile.truncate] calling file.Sync: %v", err)
+	}
+	return nil
 }
 
-func (l *LogFile) write(key string, val []byte) error {
-	err := writeEntry(l.file, key, val)
+// Close syncs and closes the log. The sequence range remains
+// available after closing, and closing a closed log is a no-op.
+func (l *LogFile) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	if l.stop != nil {
+		close(l.stop)
+		l.stop = nil
+	}
+	// the file is closed even if it can not be synced
+	err := l.file.Sync()
+	cerr := l.file.Close()
+	l.file = nil
 	if err != nil {
-		return fmt.Errorf("[LogFile.write] calling writeEntry: %v", err)
+		return fmt.Errorf("[LogFile.Close] calling file.Sync: %v", err)
 	}
-	return l.file.Sync()
+	if cerr != nil {
+		return fmt.Errorf("[LogFile.Close] calling file.Close: %v", cerr)
+	}
+	return nil
 }
@@ -0,0 +1,363 @@
+package lsm
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTestRecords(t *testing.T, l *LogFile, start, n int) []*DataRecord {
+	var recs []*DataRecord
+	for i := start; i < start+n; i++ {
+		rec := NewDataRecord(typePut, uint64(i+1), makeKey(i), makeVal(i))
+		if i%3 == 0 {
+			rec = NewDataRecord(typeDel, uint64(i+1), makeKey(i), nil)
+		}
+		err := l.WriteRecord(rec)
+		if err != nil {
+			t.Fatalf("write record: %v", err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+func replayTestRecords(t *testing.T, path string) []*DataRecord {
+	recs, _, err := replayTestRecordsMode(path, RecoverTruncate)
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	return recs
+}
+
+func replayTestRecordsMode(path string, mode RecoveryMode) ([]*DataRecord, *ReplayReport, error) {
+	l, err := OpenLogFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer l.Close()
+	var recs []*DataRecord
+	report, err := l.Replay(mode, func(rec *DataRecord) error {
+		recs = append(recs, rec)
+		return nil
+	})
+	return recs, report, err
+}
+
+func assertRecords(t *testing.T, want, got []*DataRecord) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("replayed %d records, want %d", len(got), len(want))
+	}
+	for i := range want {
+		w, g := want[i], got[i]
+		if w.Kind != g.Kind || w.Seq != g.Seq || w.Key != g.Key || !bytes.Equal(w.Value, g.Value) {
+			t.Fatalf("record %d: got %+v, want %+v", i, g, w)
+		}
+	}
+}
+
+func TestDataRecord_MarshalBinary(t *testing.T) {
+	rec := NewDataRecord(typePut, 42, "foo", []byte("bar,baz"))
+	data, err := rec.MarshalBinary()
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if len(data) != rec.Size() {
+		t.Fatalf("marshal: got %d bytes, want %d", len(data), rec.Size())
+	}
+	got := new(DataRecord)
+	err = got.UnmarshalBinary(data)
+	if err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	assertRecords(t, []*DataRecord{rec}, []*DataRecord{got})
+	if err = got.UnmarshalBinary(data[:len(data)-1]); err != ErrBadRecord {
+		t.Fatalf("unmarshal short: got %v, want %v", err, ErrBadRecord)
+	}
+	data[len(data)-1] ^= 0x01
+	if err = got.UnmarshalBinary(data); err != ErrBadChecksum {
+		t.Fatalf("unmarshal flipped bit: got %v, want %v", err, ErrBadChecksum)
+	}
+}
+
+func TestLogFile_RoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	l, err := OpenLogFile(path)
+	if err != nil {
+		t.Fatalf("open log: %v", err)
+	}
+	want := writeTestRecords(t, l, 0, 100)
+	if err = l.Close(); err != nil {
+		t.Fatalf("close log: %v", err)
+	}
+	assertRecords(t, want, replayTestRecords(t, path))
+}
+
+func TestLogFile_TornWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	l, err := OpenLogFile(path)
+	if err != nil {
+		t.Fatalf("open log: %v", err)
+	}
+	want := writeTestRecords(t, l, 0, 10)
+	l.Close()
+
+	// simulate a crash part way through writing every possible
+	// prefix of the next record, header and body included
+	torn, _ := NewDataRecord(typePut, 11, makeKey(10), makeVal(10)).MarshalBinary()
+	fi, _ := os.Stat(path)
+	for cut := 1; cut < len(torn); cut++ {
+		if err = os.Truncate(path, fi.Size()); err != nil {
+			t.Fatalf("truncate: %v", err)
+		}
+		fd, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		fd.Write(torn[:cut])
+		fd.Close()
+
+		assertRecords(t, want, replayTestRecords(t, path))
+
+		// the torn tail has been cut off
+		after, _ := os.Stat(path)
+		if after.Size() != fi.Size() {
+			t.Fatalf("cut %d: log is %d bytes, want %d", cut, after.Size(), fi.Size())
+		}
+	}
+
+	// records written after recovering land after the last good one
+	l, err = OpenLogFile(path)
+	if err != nil {
+		t.Fatalf("open log: %v", err)
+	}
+	l.Replay(RecoverTruncate, func(*DataRecord) error { return nil })
+	want = append(want, writeTestRecords(t, l, 10, 5)...)
+	l.Close()
+	assertRecords(t, want, replayTestRecords(t, path))
+}
+
+// corruptTestLog writes 10 records and flips a bit in the value of
+// the record at index bad, returning the records and the offset of
+// the corrupted one
+func corruptTestLog(t *testing.T, path string, bad int) ([]*DataRecord, int64) {
+	l, err := OpenLogFile(path)
+	if err != nil {
+		t.Fatalf("open log: %v", err)
+	}
+	recs := writeTestRecords(t, l, 0, 10)
+	l.Close()
+	var off int64
+	for _, rec := range recs[:bad] {
+		off += int64(rec.Size())
+	}
+	fd, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer fd.Close()
+	var b [1]byte
+	pos := off + int64(recs[bad].Size()) - 1
+	fd.ReadAt(b[:], pos)
+	b[0] ^= 0x80
+	fd.WriteAt(b[:], pos)
+	return recs, off
+}
+
+func TestLogFile_RecoverFail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	_, off := corruptTestLog(t, path, 4)
+	fi, _ := os.Stat(path)
+	_, _, err := replayTestRecordsMode(path, RecoverFail)
+	if !errors.Is(err, ErrBadChecksum) {
+		t.Fatalf("replay: got %v, want %v", err, ErrBadChecksum)
+	}
+	if !strings.Contains(err.Error(), strconv.FormatInt(off, 10)) {
+		t.Errorf("replay: error %q does not report offset %d", err, off)
+	}
+	after, _ := os.Stat(path)
+	if after.Size() != fi.Size() {
+		t.Fatalf("log was modified: %d bytes, want %d", after.Size(), fi.Size())
+	}
+}
+
+func TestLogFile_RecoverTruncate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	recs, off := corruptTestLog(t, path, 4)
+	got, report, err := replayTestRecordsMode(path, RecoverTruncate)
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	assertRecords(t, recs[:4], got)
+	if report.Records != 4 || report.Truncated == 0 {
+		t.Errorf("report: %+v", report)
+	}
+	after, _ := os.Stat(path)
+	if after.Size() != off {
+		t.Fatalf("log is %d bytes, want %d", after.Size(), off)
+	}
+}
+
+func TestLogFile_RecoverSkip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	recs, off := corruptTestLog(t, path, 4)
+	got, report, err := replayTestRecordsMode(path, RecoverSkip)
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	want := append(append([]*DataRecord{}, recs[:4]...), recs[5:]...)
+	assertRecords(t, want, got)
+	if len(report.Skipped) != 1 || report.Skipped[0] != off || report.Truncated != 0 {
+		t.Errorf("report: %+v", report)
+	}
+}
+
+func TestLogFile_CorruptLength(t *testing.T) {
+	for _, mode := range []RecoveryMode{RecoverFail, RecoverTruncate, RecoverSkip} {
+		path := filepath.Join(t.TempDir(), "wal.log")
+		recs, off := corruptTestLog(t, path, 4)
+		// make the value length of the record claim
+		// far more than is left in the log
+		fd, err := os.OpenFile(path, os.O_RDWR, 0600)
+		if err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		fd.WriteAt([]byte{0x80}, off+20)
+		fd.Close()
+		fi, _ := os.Stat(path)
+
+		got, report, err := replayTestRecordsMode(path, mode)
+		after, _ := os.Stat(path)
+		switch mode {
+		case RecoverFail:
+			if !errors.Is(err, ErrBadRecord) {
+				t.Fatalf("%v: replay: got %v, want %v", mode, err, ErrBadRecord)
+			}
+			if after.Size() != fi.Size() {
+				t.Fatalf("%v: log was modified: %d bytes, want %d", mode, after.Size(), fi.Size())
+			}
+		case RecoverTruncate:
+			if err != nil {
+				t.Fatalf("%v: replay: %v", mode, err)
+			}
+			assertRecords(t, recs[:4], got)
+			if after.Size() != off {
+				t.Fatalf("%v: log is %d bytes, want %d", mode, after.Size(), off)
+			}
+		case RecoverSkip:
+			if err != nil {
+				t.Fatalf("%v: replay: %v", mode, err)
+			}
+			assertRecords(t, append(append([]*DataRecord{}, recs[:4]...), recs[5:]...), got)
+			if len(report.Skipped) != 1 || report.Skipped[0] != off || after.Size() != fi.Size() {
+				t.Fatalf("%v: report: %+v, log is %d bytes", mode, report, after.Size())
+			}
+		}
+	}
+}
+
+func TestMemtable_Load(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	mem, err := NewMemtable(path, true)
+	if err != nil {
+		t.Fatalf("new memtable: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if err = mem.Put(makeKey(i), makeVal(i)); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+	}
+	for i := 0; i < 100; i += 2 {
+		if err = mem.Del(makeKey(i)); err != nil {
+			t.Fatalf("del: %v", err)
+		}
+	}
+	// crash without flushing, leaving a torn write at the tail
+	mem.wal.file.Write([]byte{typePut, 0xff, 0xff})
+	mem.Close()
+
+	mem, err = NewMemtable(path, true)
+	if err != nil {
+		t.Fatalf("reload memtable: %v", err)
+	}
+	defer mem.Close()
+	for i := 0; i < 100; i++ {
+		val, err := mem.Get(makeKey(i))
+		if i%2 == 0 {
+			if err != ErrNotFound {
+				t.Fatalf("get %q: expected tombstone, got %q", makeKey(i), val)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(val, makeVal(i)) {
+			t.Fatalf("get %q: got %q (%v)", makeKey(i), val, err)
+		}
+	}
+	if mem.seq != 150 {
+		t.Fatalf("seq: got %d, want %d", mem.seq, 150)
+	}
+}
+
+func TestLogFile_SyncPolicy(t *testing.T) {
+	dir := t.TempDir()
+	open := func(name string, p SyncPolicy) *LogFile {
+		l, err := OpenLogFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		l.SetSyncPolicy(p)
+		return l
+	}
+
+	l := open("always.log", SyncPolicy{Mode: SyncAlways})
+	writeTestRecords(t, l, 0, 10)
+	if l.syncs != 10 {
+		t.Errorf("always: got %d syncs, want %d", l.syncs, 10)
+	}
+	l.Close()
+
+	l = open("never.log", SyncPolicy{Mode: SyncNever})
+	writeTestRecords(t, l, 0, 10)
+	if l.syncs != 0 {
+		t.Errorf("never: got %d syncs, want %d", l.syncs, 0)
+	}
+	l.Close()
+
+	// the log is synced by the write that takes it past the limit
+	l = open("bytes.log", SyncPolicy{Mode: SyncBytes, Bytes: 500})
+	var before int64
+	for i := 0; l.syncs == 0; i++ {
+		before = l.size
+		writeTestRecords(t, l, i, 1)
+	}
+	if before >= 500 || l.size < 500 || l.unsynced != 0 {
+		t.Errorf("bytes: synced going from %d to %d bytes", before, l.size)
+	}
+	l.Close()
+
+	l = open("interval.log", SyncPolicy{Mode: SyncInterval, Interval: time.Millisecond})
+	writeTestRecords(t, l, 0, 10)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		l.mu.Lock()
+		syncs := l.syncs
+		l.mu.Unlock()
+		if syncs > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("interval: log was never synced")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	l.Close()
+	if got := replayTestRecords(t, l.Name()); len(got) != 10 {
+		t.Errorf("interval: replayed %d records, want %d", len(got), 10)
+	}
+}
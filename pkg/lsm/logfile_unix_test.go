@@ -0,0 +1,54 @@
+//go:build unix
+
+package lsm
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestLogFile_FailedWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	l, err := OpenLogFile(path)
+	if err != nil {
+		t.Fatalf("open log: %v", err)
+	}
+	defer l.Close()
+	want := writeTestRecords(t, l, 0, 5)
+	fi, _ := os.Stat(path)
+
+	// only part of the next group fits under the file size limit
+	restore := limitFileSize(t, fi.Size()+10)
+	err = l.WriteRecords([]*DataRecord{
+		NewDataRecord(typePut, 6, makeKey(5), makeVal(5)),
+		NewDataRecord(typePut, 7, makeKey(6), makeVal(6)),
+	})
+	restore()
+	if err == nil {
+		t.Fatalf("write: expected an error")
+	}
+	if after, _ := os.Stat(path); after.Size() != fi.Size() {
+		t.Fatalf("log is %d bytes, want %d", after.Size(), fi.Size())
+	}
+
+	// later writes land right after the last good record
+	want = append(want, writeTestRecords(t, l, 5, 5)...)
+	assertRecords(t, want, replayTestRecords(t, path))
+}
+
+// limitFileSize makes writes past size fail with EFBIG until the
+// returned func is called to lift the limit again
+func limitFileSize(t *testing.T, size int64) func() {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_FSIZE, &limit); err != nil {
+		t.Fatalf("getrlimit: %v", err)
+	}
+	small := limit
+	small.Cur = uint64(size)
+	if err := syscall.Setrlimit(syscall.RLIMIT_FSIZE, &small); err != nil {
+		t.Skipf("setrlimit: %v", err)
+	}
+	return func() { syscall.Setrlimit(syscall.RLIMIT_FSIZE, &limit) }
+}
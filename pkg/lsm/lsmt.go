@@ -1,5 +1,787 @@
 package lsm
 
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	sstableExt = ".sst"
+	dirPerms   = 0700
+)
+
+// LSMTree is a log structured merge tree backed database. Writes go
+// to the active memtable (and its write ahead log). Once the memtable
+// grows past the configured size it is sealed, writes move on to a
+// fresh memtable and log segment, and the sealed memtable is flushed
+// to an sstable in the background. Reads consult the active memtable
+// first, then the sealed ones and then every sstable, in newest to
+// oldest order. The sstables are organised into levels and compacted
+// by the configured CompactionStrategy as they grow, and the set of
+// live sstables is recorded in the manifest.
+//
+// mu guards the memtables, the list of live tables and the log, and
+// is only held exclusively for short swaps. Flushing and compaction
+// are serialized by bgMu instead, and nothing else changes the
+// manifest, so they can read it without holding mu.
 type LSMTree struct {
-	// TODO: start working on this next
+	mu       sync.RWMutex
+	dir      string
+	opts     *Options
+	manifest *Manifest      // live sstables and persisted counters
+	wal      *WAL           // segmented write ahead log
+	mem      *Memtable      // active memtable
+	imm      []*Memtable    // sealed memtables waiting to be flushed, oldest first
+	tables   *tableCache    // open sstables
+	live     []*tableMeta   // live sstables, newest first
+	filters  filterCounters // bloom filter stats of every table
+	cache    *BlockCache    // blocks of every table, nil if disabled
+	bgErr    error          // first background flush or compaction error
+	stall    *writeController
+
+	snapMu    sync.Mutex
+	snapshots list.List // live snapshots
+
+	txnMu sync.Mutex // serializes transaction commits
+	locks *lockTable // key locks of pessimistic transactions
+
+	bgMu    sync.Mutex     // held while flushing or compacting
+	flushCh chan struct{}  // wakes the background flusher
+	closing chan struct{}  // closed to stop the background flusher
+	bg      sync.WaitGroup // the background flusher
+}
+
+var _ Engine = (*LSMTree)(nil)
+
+// Open opens the database stored in dir, creating it if need be.
+// A nil opts uses DefaultOptions.
+func Open(dir string, opts *Options) (*LSMTree, error) {
+	err := os.MkdirAll(dir, dirPerms)
+	if err != nil {
+		return nil, fmt.Errorf("[Open] making dirs: %v", err)
+	}
+	t := &LSMTree{
+		dir:     dir,
+		opts:    opts.withDefaults(),
+		flushCh: make(chan struct{}, 1),
+		closing: make(chan struct{}),
+		locks:   newLockTable(),
+	}
+	t.stall = newWriteController(t.opts.SlowdownDelay, t.opts.OnWriteStall)
+	if t.opts.BlockCacheSize > 0 {
+		t.cache = NewBlockCache(t.opts.BlockCacheSize)
+	}
+	t.tables = newTableCache(dir, t.opts.MaxOpenFiles, ReaderOptions{
+		Cache: t.cache,
+		Mmap:  t.opts.MmapReads,
+	}, &t.filters)
+	t.manifest, err = OpenManifest(dir)
+	if err != nil {
+		return nil, fmt.Errorf("[Open] calling OpenManifest: %w", err)
+	}
+	t.refreshTables()
+	t.wal, err = OpenWAL(dir, t.manifest.Flushed(), t.opts.WALSync)
+	if err != nil {
+		t.manifest.Close()
+		return nil, fmt.Errorf("[Open] calling OpenWAL: %v", err)
+	}
+	err = t.recover()
+	if err != nil {
+		t.wal.Close()
+		t.manifest.Close()
+		t.tables.close()
+		return nil, fmt.Errorf("[Open] calling recover: %w", err)
+	}
+	t.updateStall()
+	t.bg.Add(1)
+	go t.flushLoop()
+	return t, nil
+}
+
+// recover replays any log segments holding writes that never made
+// it into an sstable into a new memtable, and starts a fresh log
+// segment for it. The replayed segments are kept until the memtable
+// holding their records has been flushed.
+func (t *LSMTree) recover() error {
+	mem := newMemtable(nil, t.wal.Flushed(), t.opts.MemtableSize)
+	err := t.wal.Replay(t.opts.WALRecovery, func(rec *DataRecord) error {
+		mem.apply(rec)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	mem.wal, err = t.wal.Rotate()
+	if err != nil {
+		return err
+	}
+	mem.size = mem.dataSize()
+	t.mem = mem
+	// clean up any segments that were already fully flushed
+	return t.wal.MarkFlushed(t.wal.Flushed())
+}
+
+// tableOptions returns the options new sstables
+// on level are written with
+func (t *LSMTree) tableOptions(level int) *TableOptions {
+	opts := &TableOptions{
+		BitsPerKey: t.opts.BloomBitsPerKey,
+		BlockSize:  t.opts.BlockSize,
+	}
+	if n := len(t.opts.Compression); n > 0 {
+		if level >= n {
+			level = n - 1
+		}
+		opts.Compressor = t.opts.Compression[level]
+	}
+	return opts
+}
+
+// FilterStats returns how the bloom filters of the tree's
+// sstables have fared on lookups since it was opened
+func (t *LSMTree) FilterStats() FilterStats {
+	return t.filters.stats()
+}
+
+// CacheStats returns the state of the block cache shared by the
+// tree's sstables, or zero stats if it was opened without one
+func (t *LSMTree) CacheStats() CacheStats {
+	if t.cache == nil {
+		return CacheStats{}
+	}
+	return t.cache.Stats()
+}
+
+// refreshTables rebuilds the list of tables consulted by reads
+// from the manifest, after it has been changed by an edit
+func (t *LSMTree) refreshTables() {
+	t.live = t.manifest.tables()
+}
+
+// logAndApply records edit in the manifest and swaps in the
+// resulting set of live tables for reads. The caller must hold bgMu.
+func (t *LSMTree) logAndApply(edit *versionEdit) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	err := t.manifest.logAndApply(edit)
+	if err != nil {
+		return err
+	}
+	t.refreshTables()
+	t.updateStall()
+	return nil
+}
+
+// updateStall works out how much writes need holding back from the
+// sealed memtables and live tables. The caller must hold mu.
+func (t *LSMTree) updateStall() {
+	in := stallInputs{sealed: len(t.imm)}
+	if len(t.manifest.levels) > 0 {
+		in.l0 = len(t.manifest.levels[0])
+	}
+	if e, ok := t.opts.Compaction.(CompactionEstimator); ok {
+		in.pending = e.PendingBytes(t.manifest.tableInfo())
+	}
+	state, reason := t.opts.stallState(in)
+	t.stall.set(state, reason, t.bgErr)
+}
+
+// StallStats returns the current stall state of the tree and
+// how often writes have been held back since it was opened
+func (t *LSMTree) StallStats() StallStats {
+	return t.stall.statsSnapshot()
+}
+
+// acquireTables acquires every live table in read order whose key
+// range overlaps the keys from lower up to, but not including, upper.
+// An empty upper means no bound. The returned func releases them again
+// and must always be called.
+func (t *LSMTree) acquireTables(lower, upper string) ([]*SSTableReader, func(), error) {
+	var readers []*SSTableReader
+	var nums []uint64
+	release := func() {
+		for _, num := range nums {
+			t.tables.release(num)
+		}
+	}
+	for _, meta := range t.live {
+		if meta.largest < lower || upper != "" && meta.smallest >= upper {
+			continue
+		}
+		r, err := t.tables.acquire(meta.num)
+		if err != nil {
+			return nil, release, err
+		}
+		readers = append(readers, r)
+		nums = append(nums, meta.num)
+	}
+	return readers, release, nil
+}
+
+// newTableMeta opens a newly written table, which leaves it in the
+// table cache for the reads to come, and describes it for the manifest
+func (t *LSMTree) newTableMeta(level int, num uint64, minSeq, maxSeq uint64) (*tableMeta, error) {
+	r, err := t.tables.acquire(num)
+	if err != nil {
+		return nil, err
+	}
+	defer t.tables.release(num)
+	return &tableMeta{
+		level:    level,
+		num:      num,
+		size:     r.table.size,
+		smallest: r.table.smallest,
+		largest:  r.table.largest,
+		minSeq:   minSeq,
+		maxSeq:   maxSeq,
+	}, nil
+}
+
+func (t *LSMTree) tablePath(num uint64) string {
+	return t.tables.path(num)
+}
+
+func parseFileNum(path, ext string) (uint64, error) {
+	name := strings.TrimSuffix(filepath.Base(path), ext)
+	return strconv.ParseUint(name, 10, 64)
+}
+
+// Put writes a key value pair to the tree. Writers only share the
+// tree lock, so that concurrent writes can be grouped into a single
+// log sync by the memtable; the lock is only taken exclusively when
+// the memtable has to be sealed. The write is held back first if
+// flushing or compaction have fallen behind.
+func (t *LSMTree) Put(k string, v []byte) error {
+	err := t.stall.wait()
+	if err != nil {
+		return fmt.Errorf("[LSMTree.Put] calling stall.wait: %v", err)
+	}
+	t.mu.RLock()
+	err = t.mem.Put(k, v)
+	t.mu.RUnlock()
+	if err != nil {
+		return fmt.Errorf("[LSMTree.Put] calling mem.Put: %v", err)
+	}
+	err = t.maybeSeal()
+	if err != nil {
+		return fmt.Errorf("[LSMTree.Put] calling maybeSeal: %v", err)
+	}
+	return nil
+}
+
+// maybeSeal seals the active memtable if it has grown too large
+func (t *LSMTree) maybeSeal() error {
+	t.mu.RLock()
+	full := t.mem.ShouldFlush()
+	t.mu.RUnlock()
+	if !full {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// someone else may have sealed it while we waited for the lock
+	if !t.mem.ShouldFlush() {
+		return nil
+	}
+	return t.seal()
+}
+
+func (t *LSMTree) Has(k string) bool {
+	_, err := t.Get(k)
+	return err == nil
+}
+
+func (t *LSMTree) Get(k string) ([]byte, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.get(k, maxSequence)
+}
+
+// get returns the value of k as of seq
+func (t *LSMTree) get(k string, seq uint64) ([]byte, error) {
+	it, err := t.lookup(k, seq)
+	if err != nil {
+		return nil, err
+	}
+	if it == nil || it.kind == typeDel {
+		return nil, ErrNotFound
+	}
+	return it.val, nil
+}
+
+// lookup returns the newest version of k written at or before seq,
+// which may be a tombstone, or nil if there is none. It searches the
+// memtables and then each sstable from newest to oldest and stops at
+// the first version it finds. Tables whose key range does not cover
+// k are skipped without being read.
+func (t *LSMTree) lookup(k string, seq uint64) (*item, error) {
+	it := t.mem.lookup(k, seq)
+	for i := len(t.imm) - 1; it == nil && i >= 0; i-- {
+		it = t.imm[i].lookup(k, seq)
+	}
+	for i := 0; it == nil && i < len(t.live); i++ {
+		meta := t.live[i]
+		if k < meta.smallest || k > meta.largest {
+			continue
+		}
+		r, err := t.tables.acquire(meta.num)
+		if err != nil {
+			return nil, fmt.Errorf("[LSMTree.lookup] opening table %d: %v", meta.num, err)
+		}
+		it, err = r.lookup(k, seq)
+		t.tables.release(meta.num)
+		if err != nil {
+			return nil, fmt.Errorf("[LSMTree.lookup] reading %s: %v", r.table.path, err)
+		}
+	}
+	return it, nil
+}
+
+func (t *LSMTree) GetEntry(k string) (*Entry, error) {
+	v, err := t.Get(k)
+	if err != nil {
+		return nil, err
+	}
+	return &Entry{Key: k, Value: v}, nil
+}
+
+func (t *LSMTree) Del(k string) ([]byte, error) {
+	err := t.stall.wait()
+	if err != nil {
+		return nil, fmt.Errorf("[LSMTree.Del] calling stall.wait: %v", err)
+	}
+	t.mu.RLock()
+	prev, err := t.get(k, maxSequence)
+	if err == ErrNotFound {
+		// nothing to shadow, so skip writing a tombstone
+		t.mu.RUnlock()
+		return nil, nil
+	}
+	if err != nil {
+		t.mu.RUnlock()
+		return nil, fmt.Errorf("[LSMTree.Del] calling get: %v", err)
+	}
+	err = t.mem.Del(k)
+	t.mu.RUnlock()
+	if err != nil {
+		return nil, fmt.Errorf("[LSMTree.Del] calling mem.Del: %v", err)
+	}
+	err = t.maybeSeal()
+	if err != nil {
+		return nil, fmt.Errorf("[LSMTree.Del] calling maybeSeal: %v", err)
+	}
+	return prev, nil
+}
+
+func (t *LSMTree) Lower(k string) (*Entry, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.lower(k, true, maxSequence)
+}
+
+func (t *LSMTree) Last() (*Entry, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.lower("", false, maxSequence)
+}
+
+// lower returns the entry live as of seq with the greatest key less
+// than or equal to k, or the greatest live entry overall if bounded
+// is not set. Each round picks the greatest key held by any source
+// and looks up its value as of seq; if it has none, because every
+// version is a tombstone or too new, the search continues strictly
+// below it.
+func (t *LSMTree) lower(k string, bounded bool, seq uint64) (*Entry, error) {
+	tables, release, err := t.acquireTables("", "")
+	defer release()
+	if err != nil {
+		return nil, fmt.Errorf("[LSMTree.lower] calling acquireTables: %v", err)
+	}
+	strict := false
+	for {
+		var best *item
+		for _, m := range t.memtables() {
+			var it *item
+			if bounded {
+				it = m.floor(k, strict)
+			} else {
+				it = m.last()
+			}
+			if it != nil && (best == nil || it.key > best.key) {
+				best = it
+			}
+		}
+		for _, r := range tables {
+			var it *item
+			if bounded {
+				it, err = r.floor(k, strict)
+			} else {
+				it, err = r.last()
+			}
+			if err != nil {
+				return nil, fmt.Errorf("[LSMTree.lower] reading %s: %v", r.table.path, err)
+			}
+			if it != nil && (best == nil || it.key > best.key) {
+				best = it
+			}
+		}
+		if best == nil {
+			return nil, ErrNotFound
+		}
+		v, err := t.get(best.key, seq)
+		if err == nil {
+			return &Entry{Key: best.key, Value: v}, nil
+		}
+		if err != ErrNotFound {
+			return nil, fmt.Errorf("[LSMTree.lower] calling get: %v", err)
+		}
+		k, bounded, strict = best.key, true, true
+	}
+}
+
+func (t *LSMTree) Higher(k string) (*Entry, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.higher(k, maxSequence)
+}
+
+// higher returns the entry live as of seq with the
+// least key greater than or equal to k
+func (t *LSMTree) higher(k string, seq uint64) (*Entry, error) {
+	it, release, err := t.iter(seq, k, "")
+	defer release()
+	if err != nil {
+		return nil, fmt.Errorf("[LSMTree.higher] calling iter: %v", err)
+	}
+	it.seek(k)
+	if !it.valid() {
+		if err := it.err(); err != nil {
+			return nil, fmt.Errorf("[LSMTree.higher] iterating: %v", err)
+		}
+		return nil, ErrNotFound
+	}
+	return &Entry{Key: it.key(), Value: it.value()}, nil
+}
+
+func (t *LSMTree) First() (*Entry, error) {
+	return t.Higher("")
+}
+
+func (t *LSMTree) Count() (int64, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.count(maxSequence)
+}
+
+// count returns the number of entries live as of seq
+func (t *LSMTree) count(seq uint64) (int64, error) {
+	it, release, err := t.iter(seq, "", "")
+	defer release()
+	if err != nil {
+		return 0, fmt.Errorf("[LSMTree.count] calling iter: %v", err)
+	}
+	var n int64
+	for it.seek(""); it.valid(); it.next() {
+		n++
+	}
+	if err := it.err(); err != nil {
+		return 0, fmt.Errorf("[LSMTree.count] iterating: %v", err)
+	}
+	return n, nil
+}
+
+// Iter calls fn for every entry in key order until fn returns
+// false. The tree is read locked for the duration of the call,
+// so fn must not write to the tree.
+func (t *LSMTree) Iter(fn func(k string, v []byte) bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	t.scan(maxSequence, fn)
+}
+
+// scan calls fn for every entry live as of seq in
+// key order until fn returns false
+func (t *LSMTree) scan(seq uint64, fn func(k string, v []byte) bool) {
+	it, release, err := t.iter(seq, "", "")
+	defer release()
+	if err != nil {
+		return
+	}
+	for it.seek(""); it.valid(); it.next() {
+		if !fn(it.key(), it.value()) {
+			return
+		}
+	}
+}
+
+// iter returns an iterator over the entries live as of seq with keys
+// from lower up to, but not including, upper, merging the memtables
+// and the sstables holding any such keys, along with a func releasing
+// the tables once it is done with. An empty upper means no bound.
+func (t *LSMTree) iter(seq uint64, lower, upper string) (*visibleIterator, func(), error) {
+	tables, release, err := t.acquireTables(lower, upper)
+	if err != nil {
+		return nil, release, err
+	}
+	var iters []iterator
+	var dels []rangeDel
+	for _, m := range t.memtables() {
+		iters = append(iters, m.iter())
+		dels = append(dels, m.rangeDelsAt(seq)...)
+	}
+	for _, r := range tables {
+		iters = append(iters, r.iter())
+		dels = append(dels, r.dels...)
+	}
+	it := newVisibleIterator(newMergeIterator(iters), seq, newRangeDelSet(dels, seq))
+	it.lower, it.upper = lower, upper
+	return it, release, nil
+}
+
+// NewIterator returns an Iterator over the tree as it is now, limited
+// to the keys opts allows. A nil opts allows every key. Writes made
+// after it was created are not seen through it, and the tables it
+// reads from are kept until it is closed. Tables holding no keys it
+// allows are never read. Unlike Iter it does not keep the tree locked,
+// so the tree can be written to while it is open.
+func (t *LSMTree) NewIterator(opts *IterOptions) Iterator {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.newIterator(t.mem.lastApplied(), opts)
+}
+
+// newIterator returns an Iterator over the entries live as of seq
+func (t *LSMTree) newIterator(seq uint64, opts *IterOptions) Iterator {
+	lower, upper := opts.bounds()
+	it, release, err := t.iter(seq, lower, upper)
+	if err != nil {
+		release()
+		return &dbIterator{e: fmt.Errorf("[LSMTree.newIterator] calling iter: %v", err)}
+	}
+	return &dbIterator{v: it, release: release}
+}
+
+// Scan calls fn for every entry with a key from start up to, but not
+// including, end in key order until fn returns false. An empty end
+// scans to the last key. The tree is not kept locked, so fn may write
+// to it, but writes made once the scan has started are not seen by it.
+func (t *LSMTree) Scan(start, end string, fn func(k string, v []byte) bool) error {
+	err := t.scanIter(t.NewIterator(&IterOptions{LowerBound: start, UpperBound: end}), fn)
+	if err != nil {
+		return fmt.Errorf("[LSMTree.Scan] calling scanIter: %v", err)
+	}
+	return nil
+}
+
+// ScanPrefix calls fn for every entry with a key starting with
+// prefix in key order until fn returns false, the same way as Scan
+func (t *LSMTree) ScanPrefix(prefix string, fn func(k string, v []byte) bool) error {
+	err := t.scanIter(t.NewIterator(&IterOptions{Prefix: prefix}), fn)
+	if err != nil {
+		return fmt.Errorf("[LSMTree.ScanPrefix] calling scanIter: %v", err)
+	}
+	return nil
+}
+
+// scanIter calls fn for every entry of it until fn returns false,
+// then closes it
+func (t *LSMTree) scanIter(it Iterator, fn func(k string, v []byte) bool) error {
+	for it.First(); it.Valid(); it.Next() {
+		if !fn(it.Key(), it.Value()) {
+			break
+		}
+	}
+	return it.Close()
+}
+
+// memtables returns the active memtable followed by the
+// sealed ones, newest first. The caller must hold mu.
+func (t *LSMTree) memtables() []*Memtable {
+	mems := make([]*Memtable, 0, 1+len(t.imm))
+	mems = append(mems, t.mem)
+	for i := len(t.imm) - 1; i >= 0; i-- {
+		mems = append(mems, t.imm[i])
+	}
+	return mems
+}
+
+// Flush seals the active memtable and waits until it, and any other
+// sealed memtable, has been flushed and whatever that made the
+// compaction strategy pick has been compacted
+func (t *LSMTree) Flush() error {
+	t.mu.Lock()
+	err := t.bgErr
+	if err != nil {
+		t.mu.Unlock()
+		return fmt.Errorf("[LSMTree.Flush] background error: %v", err)
+	}
+	if t.mem.Len() > 0 {
+		err = t.seal()
+	}
+	t.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("[LSMTree.Flush] calling seal: %v", err)
+	}
+	err = t.flushSealed()
+	if err != nil {
+		return fmt.Errorf("[LSMTree.Flush] calling flushSealed: %v", err)
+	}
+	return nil
+}
+
+// seal moves the active memtable to the list of sealed memtables and
+// starts an empty one writing to a new log segment, then wakes the
+// background flusher. The caller must hold mu exclusively, which
+// makes sure no write to the old memtable is still in flight.
+func (t *LSMTree) seal() error {
+	seg, err := t.wal.Rotate()
+	if err != nil {
+		return fmt.Errorf("[LSMTree.seal] calling wal.Rotate: %v", err)
+	}
+	old := t.mem
+	t.imm = append(t.imm, old)
+	t.mem = newMemtable(seg, old.seq, t.opts.MemtableSize)
+	t.updateStall()
+	select {
+	case t.flushCh <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// flushLoop flushes sealed memtables in the background
+// whenever it is woken, until the tree is closed
+func (t *LSMTree) flushLoop() {
+	defer t.bg.Done()
+	for {
+		select {
+		case <-t.flushCh:
+		case <-t.closing:
+			return
+		}
+		err := t.flushSealed()
+		if err != nil {
+			log.Printf("Background flush failed in %s: %v\n", t.dir, err)
+		}
+	}
+}
+
+// flushSealed flushes every sealed memtable, oldest first, and then
+// runs whatever compactions the compaction strategy picks. The first
+// error is kept and fails every later write, flush and compaction.
+func (t *LSMTree) flushSealed() error {
+	t.bgMu.Lock()
+	defer t.bgMu.Unlock()
+	t.mu.RLock()
+	err := t.bgErr
+	t.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	for err == nil {
+		t.mu.RLock()
+		var m *Memtable
+		if len(t.imm) > 0 {
+			m = t.imm[0]
+		}
+		t.mu.RUnlock()
+		if m == nil {
+			break
+		}
+		err = t.flush(m)
+	}
+	if err == nil {
+		err = t.compactLevels()
+	}
+	if err != nil {
+		t.mu.Lock()
+		t.bgErr = err
+		t.updateStall()
+		t.mu.Unlock()
+	}
+	return err
+}
+
+// flush writes the oldest sealed memtable m out to a new level 0
+// sstable and records it in the manifest along with the new flushed
+// sequence number. Only then is m dropped from the memtables reads
+// consult, and the log segments holding its writes are removed.
+// The caller must hold bgMu.
+func (t *LSMTree) flush(m *Memtable) error {
+	num := t.manifest.newFileNum()
+	m.mu.RLock()
+	err := m.writeTable(t.tablePath(num), t.tableOptions(0))
+	m.mu.RUnlock()
+	if err != nil {
+		t.tables.remove(num)
+		return fmt.Errorf("[LSMTree.flush] calling mem.writeTable: %v", err)
+	}
+	meta, err := t.newTableMeta(0, num, t.wal.Flushed()+1, m.seq)
+	if err != nil {
+		t.tables.remove(num)
+		return fmt.Errorf("[LSMTree.flush] calling newTableMeta: %v", err)
+	}
+	edit := &versionEdit{flushed: m.seq}
+	edit.addTable(meta)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	err = t.manifest.logAndApply(edit)
+	if err != nil {
+		if !errors.Is(err, errEditInDoubt) {
+			t.tables.remove(num)
+		}
+		return fmt.Errorf("[LSMTree.flush] calling manifest.logAndApply: %v", err)
+	}
+	t.refreshTables()
+	t.imm = t.imm[1:]
+	t.updateStall()
+	// the tree of m is left to the garbage collector
+	// rather than closed, iterators may still be reading it
+	err = t.wal.MarkFlushed(m.seq)
+	if err != nil {
+		return fmt.Errorf("[LSMTree.flush] calling wal.MarkFlushed: %v", err)
+	}
+	return nil
+}
+
+// stopBackground stops the background flusher, waiting for
+// anything it is in the middle of to finish
+func (t *LSMTree) stopBackground() {
+	select {
+	case <-t.closing:
+	default:
+		close(t.closing)
+	}
+	t.bg.Wait()
+}
+
+func (t *LSMTree) Close() error {
+	err := t.Flush()
+	if err != nil {
+		err = fmt.Errorf("[LSMTree.Close] calling Flush: %v", err)
+	}
+	t.stopBackground()
+	// whatever went wrong, everything is still let go of
+	// and the first error is the one returned
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if werr := t.wal.Close(); werr != nil && err == nil {
+		err = fmt.Errorf("[LSMTree.Close] calling wal.Close: %v", werr)
+	}
+	if merr := t.manifest.Close(); merr != nil && err == nil {
+		err = fmt.Errorf("[LSMTree.Close] calling manifest.Close: %v", merr)
+	}
+	t.mem.data.Close()
+	t.live = nil
+	if terr := t.tables.close(); terr != nil && err == nil {
+		err = fmt.Errorf("[LSMTree.Close] calling tables.close: %v", terr)
+	}
+	return err
 }
@@ -0,0 +1,497 @@
+package lsm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"testing"
+)
+
+func openTestTree(t *testing.T, dir string) *LSMTree {
+	db, err := Open(dir, &Options{MemtableSize: 16 << 10})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	return db
+}
+
+func TestLSMTree_PutGet(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestTree(t, dir)
+	for i := 0; i < 2000; i++ {
+		err := db.Put(makeKey(i), makeVal(i))
+		if err != nil {
+			t.Fatalf("put: %v", err)
+		}
+	}
+	if len(db.live) == 0 {
+		t.Fatalf("expected the memtable to have been flushed")
+	}
+	for i := 0; i < 2000; i++ {
+		val, err := db.Get(makeKey(i))
+		if err != nil {
+			t.Fatalf("get %q: %v", makeKey(i), err)
+		}
+		if !bytes.Equal(val, makeVal(i)) {
+			t.Fatalf("get %q: got %q, want %q", makeKey(i), val, makeVal(i))
+		}
+	}
+	if db.Has("nope") {
+		t.Errorf("has: expected miss")
+	}
+	err := db.Close()
+	if err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	// reopen and make sure everything made it to disk
+	db = openTestTree(t, dir)
+	defer db.Close()
+	n, err := db.Count()
+	if err != nil || n != 2000 {
+		t.Fatalf("count: got %d (%v), want %d", n, err, 2000)
+	}
+	for i := 0; i < 2000; i += 7 {
+		if !db.Has(makeKey(i)) {
+			t.Fatalf("has %q: expected hit after reopen", makeKey(i))
+		}
+	}
+}
+
+func TestLSMTree_Overwrite(t *testing.T) {
+	db := openTestTree(t, t.TempDir())
+	defer db.Close()
+	for _, v := range []string{"one", "two", "three"} {
+		if err := db.Put("key", []byte(v)); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+		if err := db.Flush(); err != nil {
+			t.Fatalf("flush: %v", err)
+		}
+	}
+	val, err := db.Get("key")
+	if err != nil || string(val) != "three" {
+		t.Fatalf("get: got %q (%v), want %q", val, err, "three")
+	}
+	n, err := db.Count()
+	if err != nil || n != 1 {
+		t.Fatalf("count: got %d (%v), want %d", n, err, 1)
+	}
+}
+
+func TestLSMTree_Ordered(t *testing.T) {
+	db := openTestTree(t, t.TempDir())
+	defer db.Close()
+	// spread even keys over a few sstables and
+	// leave the odd ones in the memtable
+	for i := 0; i < 100; i += 2 {
+		db.Put(makeKey(i), makeVal(i))
+		if i%20 == 0 {
+			db.Flush()
+		}
+	}
+	db.Flush()
+	for i := 1; i < 100; i += 2 {
+		db.Put(makeKey(i), makeVal(i))
+	}
+
+	e, err := db.First()
+	if err != nil || e.Key != makeKey(0) {
+		t.Errorf("first: got %v (%v)", e, err)
+	}
+	e, err = db.Last()
+	if err != nil || e.Key != makeKey(99) {
+		t.Errorf("last: got %v (%v)", e, err)
+	}
+	e, err = db.Lower(makeKey(50) + "x")
+	if err != nil || e.Key != makeKey(50) {
+		t.Errorf("lower: got %v (%v)", e, err)
+	}
+	e, err = db.Higher(makeKey(50) + "x")
+	if err != nil || e.Key != makeKey(51) {
+		t.Errorf("higher: got %v (%v)", e, err)
+	}
+	_, err = db.Lower("a")
+	if err != ErrNotFound {
+		t.Errorf("lower: got %v, want %v", err, ErrNotFound)
+	}
+	var i int
+	db.Iter(func(k string, v []byte) bool {
+		if k != makeKey(i) {
+			t.Errorf("iter: got %q, want %q", k, makeKey(i))
+		}
+		i++
+		return true
+	})
+	if i != 100 {
+		t.Errorf("iter: got %d entries, want %d", i, 100)
+	}
+}
+
+func TestLSMTree_Tombstones(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestTree(t, dir)
+	for i := 0; i < 100; i++ {
+		db.Put(makeKey(i), makeVal(i))
+	}
+	db.Flush()
+	// delete every even key, half of them while the tombstone
+	// stays in the memtable and half flushed to their own table
+	for i := 0; i < 100; i += 2 {
+		prev, err := db.Del(makeKey(i))
+		if err != nil || !bytes.Equal(prev, makeVal(i)) {
+			t.Fatalf("del %q: got %q (%v)", makeKey(i), prev, err)
+		}
+		if i == 50 {
+			db.Flush()
+		}
+	}
+	check := func() {
+		for i := 0; i < 100; i++ {
+			if got, want := db.Has(makeKey(i)), i%2 == 1; got != want {
+				t.Fatalf("has %q: got %v, want %v", makeKey(i), got, want)
+			}
+		}
+		n, err := db.Count()
+		if err != nil || n != 50 {
+			t.Fatalf("count: got %d (%v), want %d", n, err, 50)
+		}
+		e, err := db.First()
+		if err != nil || e.Key != makeKey(1) {
+			t.Fatalf("first: got %v (%v)", e, err)
+		}
+		e, err = db.Lower(makeKey(50))
+		if err != nil || e.Key != makeKey(49) {
+			t.Fatalf("lower: got %v (%v)", e, err)
+		}
+		e, err = db.Higher(makeKey(50))
+		if err != nil || e.Key != makeKey(51) {
+			t.Fatalf("higher: got %v (%v)", e, err)
+		}
+	}
+	check()
+
+	// deleting the last key has to be skipped over by Last
+	db.Del(makeKey(99))
+	e, err := db.Last()
+	if err != nil || e.Key != makeKey(97) {
+		t.Fatalf("last: got %v (%v)", e, err)
+	}
+	db.Put(makeKey(99), makeVal(99))
+
+	// tombstones survive a reopen
+	if err = db.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	db = openTestTree(t, dir)
+	defer db.Close()
+	check()
+
+	// a full compaction drops the tombstones and what they shadow
+	if err = db.Compact(); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	if len(db.live) != 1 || tableReader(t, db, db.live[0].num).table.count != 50 {
+		t.Fatalf("compact: got %d tables", len(db.live))
+	}
+	check()
+}
+
+func TestLSMTree_Versions(t *testing.T) {
+	db := openTestTree(t, t.TempDir())
+	defer db.Close()
+	// every write to a key is kept as a version of its own
+	var seqs []uint64
+	for i := 0; i < 3; i++ {
+		if err := db.Put("key", makeVal(i)); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+		seqs = append(seqs, db.mem.seq)
+	}
+	if _, err := db.Del("key"); err != nil {
+		t.Fatalf("del: %v", err)
+	}
+	seqs = append(seqs, db.mem.seq)
+	for i := 1; i < len(seqs); i++ {
+		if seqs[i] <= seqs[i-1] {
+			t.Fatalf("sequence numbers not increasing: %v", seqs)
+		}
+	}
+	check := func(when string) {
+		t.Helper()
+		for i, seq := range seqs[:3] {
+			v, err := db.get("key", seq)
+			if err != nil || !bytes.Equal(v, makeVal(i)) {
+				t.Fatalf("%s: get as of %d: got %q (%v), want %q", when, seq, v, err, makeVal(i))
+			}
+		}
+		if _, err := db.get("key", seqs[0]-1); err != ErrNotFound {
+			t.Fatalf("%s: get before the first put: got %v, want %v", when, err, ErrNotFound)
+		}
+		if _, err := db.Get("key"); err != ErrNotFound {
+			t.Fatalf("%s: get after del: got %v, want %v", when, err, ErrNotFound)
+		}
+		e, err := db.lower("zzz", true, seqs[1])
+		if err != nil || e.Key != "key" || !bytes.Equal(e.Value, makeVal(1)) {
+			t.Fatalf("%s: lower as of %d: got %v (%v)", when, seqs[1], e, err)
+		}
+		it, release, err := db.iter(seqs[2], "", "")
+		if err != nil {
+			t.Fatalf("%s: iter: %v", when, err)
+		}
+		it.seek("")
+		if !it.valid() || it.key() != "key" || !bytes.Equal(it.value(), makeVal(2)) {
+			t.Fatalf("%s: iter as of %d: expected the third version", when, seqs[2])
+		}
+		release()
+	}
+	check("memtable")
+	if err := db.Flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	// flushing keeps every version
+	r := tableReader(t, db, db.live[0].num)
+	if n := r.table.count; n != 4 {
+		t.Fatalf("flushed table: got %d entries, want 4", n)
+	}
+	check("sstable")
+	// compaction keeps only the newest, and drops it
+	// too since it is a tombstone shadowing nothing
+	if err := db.Compact(); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	if len(db.live) != 0 {
+		t.Fatalf("expected compaction to drop every version, got %d tables", len(db.live))
+	}
+}
+
+func ExampleOpen() {
+
+	// opens a new or existing db
+	db, err := Open("data", nil)
+	if err != nil {
+		log.Panicf("open: %v", err)
+	}
+
+	// writes a key value pair to the
+	// store, overwriting any existing
+	// entry for the key
+	err = db.Put("mykey", []byte("this is my value"))
+	if err != nil {
+		log.Panicf("put: %v", err)
+	}
+
+	// returns the value associated with
+	// key, or nil if no mapping exists
+	val, err := db.Get("mykey")
+	if err != nil || val == nil {
+		log.Panicf("get: %v", err)
+	}
+
+	// iterates while condition is true
+	db.Iter(func(k string, v []byte) bool {
+		fmt.Printf("key: %q\n", k)
+		return true
+	})
+
+	// removes the mapping for the key,
+	// returns previous value if not nil
+	prev, err := db.Del("mykey")
+	if err != nil || prev == nil {
+		log.Panicf("del: %v", err)
+	}
+
+	// calls a flush and closes the db
+	err = db.Close()
+	if err != nil {
+		log.Panicf("close: %v", err)
+	}
+}
+
+func TestLSMTree_FilterStats(t *testing.T) {
+	db := openTestTree(t, t.TempDir())
+	defer db.Close()
+	for i := 0; i < 100; i += 2 {
+		db.Put(makeKey(i), makeVal(i))
+	}
+	db.Flush()
+	for i := 1; i < 100; i += 2 {
+		if db.Has(makeKey(i)) {
+			t.Fatalf("has %q: expected miss", makeKey(i))
+		}
+	}
+	stats := db.FilterStats()
+	if stats.Misses+stats.FalsePositives != 49 {
+		t.Fatalf("stats: got %+v", stats)
+	}
+}
+
+func TestLSMTree_BlockCache(t *testing.T) {
+	db := openTestTree(t, t.TempDir())
+	defer db.Close()
+	for i := 0; i < 2000; i++ {
+		db.Put(makeKey(i), makeVal(i))
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	before := db.CacheStats()
+	if before.Pinned == 0 {
+		t.Fatalf("expected index and filter blocks to be pinned, got %+v", before)
+	}
+	for n := 0; n < 2; n++ {
+		for i := 0; i < 2000; i++ {
+			if _, err := db.Get(makeKey(i)); err != nil {
+				t.Fatalf("get %q: %v", makeKey(i), err)
+			}
+		}
+	}
+	stats := db.CacheStats()
+	if misses := stats.Misses - before.Misses; misses == 0 || misses > 2000/2 {
+		t.Errorf("misses: got %d", misses)
+	}
+	if hits := stats.Hits - before.Hits; hits < 3000 {
+		t.Errorf("hits: got %d", hits)
+	}
+
+	// without a cache every read goes to disk
+	nc, err := Open(t.TempDir(), &Options{BlockCacheSize: -1})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer nc.Close()
+	nc.Put("a", []byte("1"))
+	nc.Flush()
+	if v, err := nc.Get("a"); err != nil || string(v) != "1" {
+		t.Fatalf("get: got %q (%v)", v, err)
+	}
+	if stats := nc.CacheStats(); stats != (CacheStats{}) {
+		t.Fatalf("stats: got %+v", stats)
+	}
+}
+
+func TestLSMTree_MmapReads(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, &Options{MemtableSize: 16 << 10, MmapReads: true, MaxOpenFiles: 2})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer db.Close()
+	for i := 0; i < 2000; i++ {
+		db.Put(makeKey(i), makeVal(i))
+	}
+	vals := make([][]byte, 2000)
+	for i := range vals {
+		if vals[i], err = db.Get(makeKey(i)); err != nil {
+			t.Fatalf("get %q: %v", makeKey(i), err)
+		}
+	}
+	// compacting closes, unmaps and deletes every table read above
+	if err = db.Compact(); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	for i, v := range vals {
+		if !bytes.Equal(v, makeVal(i)) {
+			t.Fatalf("value %d after compaction: got %q", i, v)
+		}
+	}
+	if n, err := db.Count(); err != nil || n != 2000 {
+		t.Fatalf("count: got %d (%v), want %d", n, err, 2000)
+	}
+}
+
+func TestLSMTree_BackgroundFlush(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, &Options{
+		MemtableSize:            16 << 10,
+		MemtableSlowdownTrigger: -1,
+		MemtableStopTrigger:     -1,
+	})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer db.Close()
+	// hold off the background flusher, as a slow flush would
+	db.bgMu.Lock()
+	for i := 0; i < 2000; i++ {
+		if err := db.Put(makeKey(i), makeVal(i)); err != nil {
+			db.bgMu.Unlock()
+			t.Fatalf("put: %v", err)
+		}
+		if i%3 == 0 {
+			db.Del(makeKey(i - 1))
+		}
+	}
+	db.mu.RLock()
+	sealed, live := len(db.imm), len(db.live)
+	db.mu.RUnlock()
+	if sealed < 2 || live != 0 {
+		db.bgMu.Unlock()
+		t.Fatalf("expected writes to carry on into new memtables, got %d sealed and %d tables", sealed, live)
+	}
+	// reads are served from the sealed memtables meanwhile
+	check := func() {
+		for i := 0; i < 2000; i++ {
+			val, err := db.Get(makeKey(i))
+			if (i+1)%3 == 0 && i < 1998 {
+				if err != ErrNotFound {
+					t.Fatalf("get %q: expected deleted, got %q (%v)", makeKey(i), val, err)
+				}
+				continue
+			}
+			if err != nil || !bytes.Equal(val, makeVal(i)) {
+				t.Fatalf("get %q: got %q (%v)", makeKey(i), val, err)
+			}
+		}
+		if e, err := db.Last(); err != nil || e.Key != makeKey(1999) {
+			t.Fatalf("last: got %v (%v)", e, err)
+		}
+		if n, err := db.Count(); err != nil || n != 2000-666 {
+			t.Fatalf("count: got %d (%v), want %d", n, err, 2000-666)
+		}
+	}
+	check()
+	db.bgMu.Unlock()
+
+	if err := db.Flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if len(db.imm) != 0 || len(db.live) == 0 {
+		t.Fatalf("expected every memtable to be flushed, got %d sealed and %d tables", len(db.imm), len(db.live))
+	}
+	if n := countSegments(t, dir); n != 1 {
+		t.Fatalf("segments: got %d, want %d", n, 1)
+	}
+	check()
+}
+
+func TestLSMTree_CloseAfterBackgroundError(t *testing.T) {
+	db := openTestTree(t, t.TempDir())
+	for i := 0; i < 100; i++ {
+		db.Put(makeKey(i), makeVal(i))
+	}
+	db.mu.Lock()
+	db.bgErr = errors.New("boom")
+	db.mu.Unlock()
+	if err := db.Flush(); err == nil || strings.Contains(err.Error(), "seal") {
+		t.Fatalf("flush: got %v, want the background error", err)
+	}
+	// the tree can still be closed, and lets go of everything
+	err := db.Close()
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("close: got %v, want the background error", err)
+	}
+	for _, seg := range db.wal.segments {
+		if seg.log.file != nil {
+			t.Fatalf("%s: expected it to be closed", seg.log.Name())
+		}
+	}
+	if db.manifest.file != nil {
+		t.Fatalf("expected the manifest to be closed")
+	}
+	if n := db.tables.open(); n != 0 {
+		t.Fatalf("open tables: got %d, want %d", n, 0)
+	}
+}
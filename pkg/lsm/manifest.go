@@ -0,0 +1,490 @@
+package lsm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The manifest is the record of which sstables make up the database.
+// It is a log of version edits, each one adding and removing tables
+// and moving the persisted counters on. Replaying every edit in order
+// rebuilds the current set of live tables.
+//
+// manifest record:
+//	crc u32 | len u32 | edit
+//
+// crc is the CRC32C of the edit and both integers are little endian.
+// An edit is a sequence of tagged fields, with every number encoded
+// as a uvarint and every key as a uvarint length followed by its bytes:
+//
+//	tagFlushed  seq
+//	tagNextFile num
+//	tagAddTable level | num | size | smallest | largest | minseq | maxseq
+//	tagDelTable level | num
+//
+// The manifest in use is named by the CURRENT file. Every time the
+// database is opened, and whenever the manifest grows too large, a
+// new manifest is started holding a single edit that describes the
+// whole current state, and CURRENT is atomically switched over to it.
+
+const (
+	currentFileName = "CURRENT"
+	manifestPrefix  = "MANIFEST-"
+	manifestMaxSize = 4 << 20
+)
+
+const (
+	tagFlushed = iota + 1
+	tagNextFile
+	tagAddTable
+	tagDelTable
+)
+
+var ErrBadManifest = errors.New("manifest: corrupt edit")
+
+// errEditInDoubt is returned when an edit failed to be logged and
+// could not be cut back out of the manifest either, so it may yet
+// turn out to be durable. Any table it adds must be kept.
+var errEditInDoubt = errors.New("manifest: edit may have been logged")
+
+// tableMeta describes a live sstable as recorded in the manifest
+type tableMeta struct {
+	level    int
+	num      uint64
+	size     int64
+	smallest string
+	largest  string
+	minSeq   uint64 // sequence range of the writes held in the table
+	maxSeq   uint64
+}
+
+// versionEdit is a single change to the set of live sstables. Zero
+// counters are left unchanged. Tables are removed before any are
+// added, so a table can be moved between levels in one edit.
+type versionEdit struct {
+	flushed  uint64
+	nextFile uint64
+	added    []*tableMeta
+	removed  []*tableMeta // only level and num are used
+}
+
+func (e *versionEdit) addTable(meta *tableMeta) {
+	e.added = append(e.added, meta)
+}
+
+func (e *versionEdit) delTable(level int, num uint64) {
+	e.removed = append(e.removed, &tableMeta{level: level, num: num})
+}
+
+func (e *versionEdit) encode() []byte {
+	var b []byte
+	if e.flushed > 0 {
+		b = binary.AppendUvarint(b, tagFlushed)
+		b = binary.AppendUvarint(b, e.flushed)
+	}
+	if e.nextFile > 0 {
+		b = binary.AppendUvarint(b, tagNextFile)
+		b = binary.AppendUvarint(b, e.nextFile)
+	}
+	for _, t := range e.removed {
+		b = binary.AppendUvarint(b, tagDelTable)
+		b = binary.AppendUvarint(b, uint64(t.level))
+		b = binary.AppendUvarint(b, t.num)
+	}
+	for _, t := range e.added {
+		b = binary.AppendUvarint(b, tagAddTable)
+		b = binary.AppendUvarint(b, uint64(t.level))
+		b = binary.AppendUvarint(b, t.num)
+		b = binary.AppendUvarint(b, uint64(t.size))
+		b = appendString(b, t.smallest)
+		b = appendString(b, t.largest)
+		b = binary.AppendUvarint(b, t.minSeq)
+		b = binary.AppendUvarint(b, t.maxSeq)
+	}
+	return b
+}
+
+func (e *versionEdit) decode(b []byte) error {
+	var err error
+	var tag, level, size uint64
+	for len(b) > 0 {
+		if tag, b, err = readUvarint(b); err != nil {
+			return err
+		}
+		switch tag {
+		case tagFlushed:
+			e.flushed, b, err = readUvarint(b)
+		case tagNextFile:
+			e.nextFile, b, err = readUvarint(b)
+		case tagDelTable:
+			t := new(tableMeta)
+			if level, b, err = readUvarint(b); err != nil {
+				return err
+			}
+			t.level = int(level)
+			t.num, b, err = readUvarint(b)
+			e.removed = append(e.removed, t)
+		case tagAddTable:
+			t := new(tableMeta)
+			if level, b, err = readUvarint(b); err != nil {
+				return err
+			}
+			t.level = int(level)
+			if t.num, b, err = readUvarint(b); err != nil {
+				return err
+			}
+			if size, b, err = readUvarint(b); err != nil {
+				return err
+			}
+			t.size = int64(size)
+			if t.smallest, b, err = readString(b); err != nil {
+				return ErrBadManifest
+			}
+			if t.largest, b, err = readString(b); err != nil {
+				return ErrBadManifest
+			}
+			if t.minSeq, b, err = readUvarint(b); err != nil {
+				return err
+			}
+			t.maxSeq, b, err = readUvarint(b)
+			e.added = append(e.added, t)
+		default:
+			return ErrBadManifest
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readUvarint(b []byte) (uint64, []byte, error) {
+	n, i := binary.Uvarint(b)
+	if i <= 0 {
+		return 0, nil, ErrBadManifest
+	}
+	return n, b[i:], nil
+}
+
+// Manifest tracks the live sstables of a database, level by level,
+// along with the sequence number up to which every write has been
+// flushed and the next unused file number. Every change is made by
+// logging a version edit to the manifest file before it is applied.
+type Manifest struct {
+	dir      string
+	file     *os.File
+	num      uint64         // file number of the manifest in use
+	size     int64          // bytes written to the manifest in use
+	levels   [][]*tableMeta // live tables, level 0 oldest data first, others by key
+	flushed  uint64         // every write up to this seq is in an sstable
+	nextFile uint64         // number used to name the next file
+	failed   error          // set once an edit is in doubt
+}
+
+// OpenManifest loads the manifest named by the CURRENT file in dir,
+// or starts an empty one if there is none, and then rolls it over to
+// a fresh manifest. Any sstable or old manifest in dir that is not
+// part of the database is removed.
+func OpenManifest(dir string) (*Manifest, error) {
+	m := &Manifest{dir: dir, nextFile: 1}
+	data, err := os.ReadFile(filepath.Join(dir, currentFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("[OpenManifest] reading CURRENT: %v", err)
+	}
+	if err == nil {
+		name := strings.TrimSpace(string(data))
+		m.num, err = parseFileNum(strings.TrimPrefix(name, manifestPrefix), "")
+		if err != nil {
+			return nil, fmt.Errorf("[OpenManifest] bad CURRENT %q: %v", name, err)
+		}
+		err = m.replay(filepath.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("[OpenManifest] calling replay: %w", err)
+		}
+	}
+	err = m.rollover()
+	if err != nil {
+		return nil, fmt.Errorf("[OpenManifest] calling rollover: %v", err)
+	}
+	err = m.removeObsolete()
+	if err != nil {
+		m.Close()
+		return nil, fmt.Errorf("[OpenManifest] calling removeObsolete: %v", err)
+	}
+	return m, nil
+}
+
+// replay applies every edit found in the manifest at path. A record
+// cut short or failing its checksum at the end of the file was never
+// acknowledged, so it is ignored; anything else that fails to decode
+// is an error.
+func (m *Manifest) replay(path string) error {
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	fi, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	br := bufio.NewReader(fd)
+	var hdr [8]byte
+	for off := int64(0); ; {
+		_, err = io.ReadFull(br, hdr[:])
+		if err == io.EOF {
+			return nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			log.Printf("Ignoring torn edit at the end of %s\n", path)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		n := int64(binary.LittleEndian.Uint32(hdr[4:8]))
+		off += 8 + n
+		if off > fi.Size() {
+			log.Printf("Ignoring torn edit at the end of %s\n", path)
+			return nil
+		}
+		data := make([]byte, n)
+		_, err = io.ReadFull(br, data)
+		if err != nil {
+			return err
+		}
+		if crc32.Checksum(data, crcTable) != binary.LittleEndian.Uint32(hdr[0:4]) {
+			if off == fi.Size() {
+				// the header made it to disk but not all of the body
+				log.Printf("Ignoring torn edit at the end of %s\n", path)
+				return nil
+			}
+			return ErrBadManifest
+		}
+		edit := new(versionEdit)
+		err = edit.decode(data)
+		if err != nil {
+			return err
+		}
+		m.apply(edit)
+	}
+}
+
+// apply applies an edit to the in memory state
+func (m *Manifest) apply(e *versionEdit) {
+	if e.flushed > m.flushed {
+		m.flushed = e.flushed
+	}
+	if e.nextFile > m.nextFile {
+		m.nextFile = e.nextFile
+	}
+	for _, t := range e.removed {
+		if t.level >= len(m.levels) {
+			continue
+		}
+		tables := m.levels[t.level]
+		for i := range tables {
+			if tables[i].num == t.num {
+				m.levels[t.level] = append(tables[:i:i], tables[i+1:]...)
+				break
+			}
+		}
+	}
+	for _, t := range e.added {
+		for t.level >= len(m.levels) {
+			m.levels = append(m.levels, nil)
+		}
+		m.levels[t.level] = append(m.levels[t.level], t)
+		if t.num >= m.nextFile {
+			m.nextFile = t.num + 1
+		}
+	}
+	for level, tables := range m.levels {
+		if level == 0 {
+			sortLevel0(tables)
+			continue
+		}
+		sort.Slice(tables, func(i, j int) bool {
+			return tables[i].smallest < tables[j].smallest
+		})
+	}
+}
+
+// logAndApply durably records an edit in the manifest and then
+// applies it, rolling over to a new manifest if this one has grown
+// too large. The edit is not applied if it could not be logged. If
+// it is not known whether it was, errEditInDoubt is returned and every
+// later edit fails, since anything appended after it would be lost.
+func (m *Manifest) logAndApply(e *versionEdit) error {
+	if m.failed != nil {
+		return fmt.Errorf("[Manifest.logAndApply] failed earlier: %v", m.failed)
+	}
+	e.nextFile = m.nextFile
+	err := m.write(e)
+	if errors.Is(err, errEditInDoubt) {
+		m.failed = err
+	}
+	if err != nil {
+		return fmt.Errorf("[Manifest.logAndApply] calling write: %w", err)
+	}
+	m.apply(e)
+	if m.size > manifestMaxSize {
+		err = m.rollover()
+		if err != nil {
+			return fmt.Errorf("[Manifest.logAndApply] calling rollover: %v", err)
+		}
+	}
+	return nil
+}
+
+// write appends an edit to the manifest file and syncs it. If either
+// fails the file is cut back to where the edit started, and if that
+// fails too the error wraps errEditInDoubt.
+func (m *Manifest) write(e *versionEdit) error {
+	data := e.encode()
+	rec := make([]byte, 8+len(data))
+	binary.LittleEndian.PutUint32(rec[0:4], crc32.Checksum(data, crcTable))
+	binary.LittleEndian.PutUint32(rec[4:8], uint32(len(data)))
+	copy(rec[8:], data)
+	_, err := m.file.Write(rec)
+	if err == nil {
+		err = m.file.Sync()
+	}
+	if err != nil {
+		terr := m.file.Truncate(m.size)
+		if terr == nil {
+			_, terr = m.file.Seek(m.size, io.SeekStart)
+		}
+		if terr != nil {
+			return fmt.Errorf("%w: %v", errEditInDoubt, err)
+		}
+		return err
+	}
+	m.size += int64(len(rec))
+	return nil
+}
+
+// rollover starts a new manifest holding a snapshot of the current
+// state, points CURRENT at it and removes the previous manifest. If
+// anything fails before CURRENT is switched the old manifest stays
+// in use and the new one is left to be cleaned up on the next open.
+func (m *Manifest) rollover() error {
+	num := m.newFileNum()
+	path := filepath.Join(m.dir, fmt.Sprintf("%s%06d", manifestPrefix, num))
+	fd, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, filePermissions)
+	if err != nil {
+		return fmt.Errorf("[Manifest.rollover] creating %s: %v", path, err)
+	}
+	snap := &versionEdit{flushed: m.flushed, nextFile: m.nextFile}
+	for _, tables := range m.levels {
+		snap.added = append(snap.added, tables...)
+	}
+	prev := m.file
+	m.file, m.size = fd, 0
+	err = m.write(snap)
+	if err == nil {
+		err = writeFileAtomic(filepath.Join(m.dir, currentFileName),
+			[]byte(filepath.Base(path)+"\n"))
+	}
+	if err != nil {
+		fd.Close()
+		m.file = prev
+		return fmt.Errorf("[Manifest.rollover] switching to %s: %v", path, err)
+	}
+	if prev != nil {
+		prev.Close()
+	}
+	if m.num > 0 {
+		os.Remove(filepath.Join(m.dir, fmt.Sprintf("%s%06d", manifestPrefix, m.num)))
+	}
+	m.num = num
+	return syncDir(m.dir)
+}
+
+// removeObsolete removes every sstable, partially written table and
+// manifest in the database directory that is no longer in use
+func (m *Manifest) removeObsolete() error {
+	live := make(map[uint64]bool)
+	for _, tables := range m.levels {
+		for _, t := range tables {
+			live[t.num] = true
+		}
+	}
+	names, err := filepath.Glob(filepath.Join(m.dir, "*"))
+	if err != nil {
+		return err
+	}
+	for _, path := range names {
+		base := filepath.Base(path)
+		var obsolete bool
+		switch {
+		case strings.HasSuffix(base, sstableExt+".tmp"):
+			obsolete = true
+		case strings.HasSuffix(base, sstableExt):
+			num, err := parseFileNum(path, sstableExt)
+			obsolete = err == nil && !live[num]
+		case strings.HasPrefix(base, manifestPrefix):
+			obsolete = base != fmt.Sprintf("%s%06d", manifestPrefix, m.num)
+		}
+		if !obsolete {
+			continue
+		}
+		log.Printf("Removing obsolete file %s\n", path)
+		err = os.Remove(path)
+		if err != nil {
+			return err
+		}
+	}
+	return syncDir(m.dir)
+}
+
+// newFileNum reserves the next file number. The reservation only
+// becomes durable with the next edit that is logged.
+func (m *Manifest) newFileNum() uint64 {
+	num := m.nextFile
+	m.nextFile++
+	return num
+}
+
+// Flushed returns the sequence number up to which every write has
+// been flushed to an sstable
+func (m *Manifest) Flushed() uint64 {
+	return m.flushed
+}
+
+// tables returns every live table in the order reads must consult
+// them: level 0 newest first, followed by each deeper level in turn
+func (m *Manifest) tables() []*tableMeta {
+	var tables []*tableMeta
+	for level, lt := range m.levels {
+		if level == 0 {
+			for i := len(lt) - 1; i >= 0; i-- {
+				tables = append(tables, lt[i])
+			}
+			continue
+		}
+		tables = append(tables, lt...)
+	}
+	return tables
+}
+
+func (m *Manifest) Close() error {
+	if m.file == nil {
+		return nil
+	}
+	err := m.file.Close()
+	if err != nil {
+		return fmt.Errorf("[Manifest.Close] calling file.Close: %v", err)
+	}
+	m.file = nil
+	return nil
+}
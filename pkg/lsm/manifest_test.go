@@ -0,0 +1,118 @@
+package lsm
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestVersionEdit_RoundTrip(t *testing.T) {
+	edit := &versionEdit{flushed: 42, nextFile: 7}
+	edit.delTable(0, 3)
+	edit.addTable(&tableMeta{
+		level:    1,
+		num:      6,
+		size:     4096,
+		smallest: makeKey(0),
+		largest:  makeKey(99),
+		minSeq:   1,
+		maxSeq:   42,
+	})
+	got := new(versionEdit)
+	if err := got.decode(edit.encode()); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !reflect.DeepEqual(edit, got) {
+		t.Fatalf("round trip: got %+v, want %+v", got, edit)
+	}
+	if err := got.decode([]byte{tagAddTable, 1}); err != ErrBadManifest {
+		t.Fatalf("decode short edit: got %v, want %v", err, ErrBadManifest)
+	}
+}
+
+func currentManifest(t *testing.T, dir string) string {
+	data, err := os.ReadFile(filepath.Join(dir, currentFileName))
+	if err != nil {
+		t.Fatalf("read CURRENT: %v", err)
+	}
+	return filepath.Join(dir, strings.TrimSpace(string(data)))
+}
+
+func TestManifest_Recover(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestTree(t, dir)
+	for i := 0; i < 30; i++ {
+		db.Put(makeKey(i), makeVal(i))
+		if i%10 == 9 {
+			db.Flush()
+		}
+	}
+	db.Compact()
+	db.Put(makeKey(30), makeVal(30))
+	db.Flush()
+	want := db.manifest.levels
+	crashTestTree(t, db)
+
+	// a torn edit at the end of the manifest is ignored, whether it
+	// was cut short in its header or only its body is missing
+	for _, torn := range [][]byte{
+		{1, 2, 3, 4, 0xff},
+		{1, 2, 3, 4, 3, 0, 0, 0, 0, 0, 0},
+	} {
+		fd, err := os.OpenFile(currentManifest(t, dir), os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			t.Fatalf("open manifest: %v", err)
+		}
+		fd.Write(torn)
+		fd.Close()
+
+		db = openTestTree(t, dir)
+		if !reflect.DeepEqual(db.manifest.levels, want) {
+			t.Fatalf("levels: got %v, want %v", db.manifest.levels, want)
+		}
+		if len(db.live) != 2 {
+			t.Fatalf("tables: got %d, want %d", len(db.live), 2)
+		}
+		if n, _ := db.Count(); n != 31 {
+			t.Fatalf("count: got %d, want %d", n, 31)
+		}
+		// only the manifest that was just rolled over to is left
+		names, _ := filepath.Glob(filepath.Join(dir, manifestPrefix+"*"))
+		if len(names) != 1 || names[0] != currentManifest(t, dir) {
+			t.Fatalf("manifests: got %v", names)
+		}
+		crashTestTree(t, db)
+	}
+}
+
+func TestManifest_RemoveObsolete(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestTree(t, dir)
+	for i := 0; i < 10; i++ {
+		db.Put(makeKey(i), makeVal(i))
+	}
+	db.Close()
+
+	// leave behind the kind of files a crash part way through
+	// a flush, a compaction or a rollover would
+	orphans := []string{
+		"000999.sst",
+		"001000.sst.tmp",
+		manifestPrefix + "000998",
+	}
+	for _, name := range orphans {
+		os.WriteFile(filepath.Join(dir, name), []byte("junk"), 0600)
+	}
+	db = openTestTree(t, dir)
+	defer db.Close()
+	for _, name := range orphans {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s: expected it to be removed, got %v", name, err)
+		}
+	}
+	if n, _ := db.Count(); n != 10 {
+		t.Fatalf("count: got %d, want %d", n, 10)
+	}
+}
@@ -0,0 +1,64 @@
+//go:build unix
+
+package lsm
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestManifest_FailedEdit(t *testing.T) {
+	dir := t.TempDir()
+	m, err := OpenManifest(dir)
+	if err != nil {
+		t.Fatalf("open manifest: %v", err)
+	}
+	t.Cleanup(func() { m.Close() })
+	edit := func(num uint64) *versionEdit {
+		e := &versionEdit{flushed: num * 10}
+		e.addTable(&tableMeta{
+			level:    0,
+			num:      num,
+			size:     4096,
+			smallest: makeKey(0),
+			largest:  makeKey(9),
+			minSeq:   num*10 - 9,
+			maxSeq:   num * 10,
+		})
+		return e
+	}
+	if err = m.logAndApply(edit(1)); err != nil {
+		t.Fatalf("log edit: %v", err)
+	}
+	path := currentManifest(t, dir)
+	fi, _ := os.Stat(path)
+
+	// only part of the next edit fits under the file size limit
+	restore := limitFileSize(t, fi.Size()+4)
+	err = m.logAndApply(edit(2))
+	restore()
+	if err == nil {
+		t.Fatalf("log edit: expected an error")
+	}
+	if after, _ := os.Stat(path); after.Size() != fi.Size() {
+		t.Fatalf("manifest is %d bytes, want %d", after.Size(), fi.Size())
+	}
+	if m.Flushed() != 10 || len(m.tables()) != 1 {
+		t.Fatalf("failed edit was applied: flushed %d, tables %d", m.Flushed(), len(m.tables()))
+	}
+
+	// the next edit lands right after the last good one
+	if err = m.logAndApply(edit(3)); err != nil {
+		t.Fatalf("log edit: %v", err)
+	}
+	want := m.levels
+	m.Close()
+	m, err = OpenManifest(dir)
+	if err != nil {
+		t.Fatalf("reopen manifest: %v", err)
+	}
+	if !reflect.DeepEqual(m.levels, want) {
+		t.Fatalf("levels: got %v, want %v", m.levels, want)
+	}
+}
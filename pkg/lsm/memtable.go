@@ -3,131 +3,265 @@ package lsm
 import (
 	"fmt"
 	"github.com/scottcagno/lsmt/pkg/lsm/rbtree"
-	"io"
 	"log"
 	"os"
 	"sync"
-	"time"
 )
 
 type Memtable struct {
 	mu        sync.RWMutex   // lock
-	data      *rbtree.RBTree // memtable sorted index
+	data      *rbtree.RBTree // every version written, by internal key
+	rangeDels []rangeDel     // range deletes, in the order they were written
+	delsSize  int64          // size in bytes of the range deletes
 	wal       *LogFile       // log file for crashes
 	threshold int64          // sstable flush threshold
 	size      int64          // size in bytes (used to check if threshold has been met)
+	seq       uint64         // sequence number of the last write
+	applied   uint64         // sequence number of the last write applied, guarded by mu
+	qmu       sync.Mutex     // guards the commit queue
+	queue     []*commitReq   // writes waiting to be logged, in order
 }
 
+// maxCommitBytes caps how many bytes of records a commit
+// group leader will write to the log in one go
+const maxCommitBytes = 1 << 20
+
+// commitReq is a single write waiting in the commit queue
+type commitReq struct {
+	rec  *DataRecord
+	err  error
+	done bool
+	wake chan struct{} // closed when done or when made leader
+}
+
+// NewMemtable returns a standalone memtable that owns the log file
+// found at path, replaying it if dynamicLoad is set
 func NewMemtable(path string, dynamicLoad bool) (*Memtable, error) {
 	wal, err := OpenLogFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("[NewMemtable] calling OpenLogFile: %v", err)
 	}
-	m := &Memtable{
-		data: rbtree.NewRBTree(),
-		wal:  wal,
-		size: wal.size,
-	}
+	m := newMemtable(wal, 0, DefaultOptions.MemtableSize)
 	if dynamicLoad {
-		m.Load()
+		err = m.Load()
+		if err != nil {
+			wal.Close()
+			return nil, fmt.Errorf("[NewMemtable] calling Load: %v", err)
+		}
 	}
 	return m, nil
 }
 
+// newMemtable returns an empty memtable that writes to the provided
+// log segment, numbering writes on from seq, and that should be
+// flushed once it holds close to threshold bytes
+func newMemtable(wal *LogFile, seq uint64, threshold int64) *Memtable {
+	return &Memtable{
+		data:      rbtree.NewRBTree(),
+		wal:       wal,
+		seq:       seq,
+		applied:   seq,
+		threshold: threshold,
+	}
+}
+
+// Load replays the write ahead log into the memtable
 func (m *Memtable) Load() error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	log.Printf("Loading memtable data from AOF/WAL (%s)\n", m.wal.file.Name())
 
-	_, err := m.wal.file.Seek(0, io.SeekStart)
+	report, err := m.wal.Replay(RecoverTruncate, func(rec *DataRecord) error {
+		m.apply(rec)
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("[Memtable.Load] seek: %v", err)
+		return fmt.Errorf("[Memtable.Load] calling wal.Replay: %w", err)
+	}
+	if len(report.Skipped) > 0 || report.Truncated > 0 {
+		log.Printf("Recovered %d records from %s, skipped %d corrupt records, truncated %d bytes\n",
+			report.Records, m.wal.file.Name(), len(report.Skipped), report.Truncated)
 	}
 
-	for {
-		record, err := m.wal.ReadRecord()
-		if err != nil && err != io.EOF {
-			return fmt.Errorf("[Memtable.Load] wal.Read: %v", err)
-		}
-		if err == io.EOF {
-			return nil
-		}
-		m.data.Put(record.Key, record.Value)
-	}
-
-	/*
-		if m.size > 0 {
-			for {
-				var e entry
-				err := m.wal.ReadEntry(&e)
-				if err == io.EOF {
-					break
-				}
-				m.data.Put(e.key, []byte(e.val))
-			}
+	// update size
+	m.size = m.dataSize()
+	return nil
+}
+
+// apply adds a record that has already been written to the log
+// to the memtable as a new version of its key, leaving any older
+// versions in place, or every write of a batch record
+func (m *Memtable) apply(rec *DataRecord) {
+	switch rec.Kind {
+	case typeBatch:
+		// the batch was checked when the record was
+		// decoded, or built from a WriteBatch
+		ops, _ := readBatch(rec.Value, rec.Seq)
+		for i := range ops {
+			m.add(&ops[i])
 		}
-	*/
+	case typeDel:
+		m.add(&item{key: rec.Key, seq: rec.Seq, kind: typeDel})
+	default:
+		m.add(&item{key: rec.Key, seq: rec.Seq, kind: typePut, val: rec.Value})
+	}
+	last := rec.lastSeq()
+	if last > m.seq {
+		m.seq = last
+	}
+	if last > m.applied {
+		m.applied = last
+	}
 }
 
-func (m *Memtable) Put(key string, val []byte) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+// add adds a version of a key, or a range delete, to the memtable
+func (m *Memtable) add(it *item) {
+	switch it.kind {
+	case typeRangeDel:
+		m.rangeDels = append(m.rangeDels, rangeDel{start: it.key, end: string(it.val), seq: it.seq})
+		m.delsSize += int64(len(it.key) + len(it.val))
+	case typeDel:
+		m.data.Put(makeInternalKey(it.key, it.seq, typeDel), nil)
+	default:
+		m.data.Put(makeInternalKey(it.key, it.seq, typePut), it.val)
+	}
+}
 
-	// write put entry to the logile
-	err := m.wal.WritePut(key, val)
+// dataSize returns the size in bytes of everything held
+func (m *Memtable) dataSize() int64 {
+	return m.data.Size() + m.delsSize
+}
+
+// lastApplied returns the sequence number of the last write that
+// has been applied, and so can be seen by reads
+func (m *Memtable) lastApplied() uint64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.applied
+}
+
+func (m *Memtable) Put(key string, val []byte) error {
+	// write put entry to the logfile and add it to the memtable
+	err := m.commit(NewDataRecord(typePut, 0, key, val))
 	if err != nil {
-		return fmt.Errorf("[Memtable.Put] calling WritePut: %v", err)
+		return fmt.Errorf("[Memtable.Put] calling commit: %v", err)
+	}
+	return nil
+}
+
+// commit writes rec to the log and then applies it to the memtable,
+// assigning it the next sequence number on the way. Concurrent
+// callers queue up, and whoever is at the head of the queue becomes
+// the leader: it writes the records of everyone queued behind it to
+// the log with one write and one sync, applies them in order, then
+// wakes its followers and hands leadership to the next in line.
+// Nobody returns before their own record has been logged.
+func (m *Memtable) commit(rec *DataRecord) error {
+	req := &commitReq{rec: rec, wake: make(chan struct{})}
+	m.qmu.Lock()
+	m.queue = append(m.queue, req)
+	leader := len(m.queue) == 1
+	m.qmu.Unlock()
+	if !leader {
+		<-req.wake
+		if req.done {
+			return req.err
+		}
 	}
 
-	// add entry to the memtable
-	m.data.Put(key, val)
+	// gather up a group of waiting writes and number them
+	m.qmu.Lock()
+	var size int
+	n := 0
+	for n < len(m.queue) && (n == 0 || size+m.queue[n].rec.Size() <= maxCommitBytes) {
+		size += m.queue[n].rec.Size()
+		n++
+	}
+	group := m.queue[:n]
+	recs := make([]*DataRecord, n)
+	for i, r := range group {
+		r.rec.Seq = m.seq + 1
+		m.seq = r.rec.lastSeq()
+		recs[i] = r.rec
+	}
+	m.qmu.Unlock()
 
-	// update size (if need be)
-	s := m.data.Size()
-	if s > m.size {
-		m.size += s
+	err := m.wal.WriteRecords(recs)
+	if err == nil {
+		m.mu.Lock()
+		for _, r := range recs {
+			m.apply(r)
+		}
+		m.size = m.dataSize()
+		m.mu.Unlock()
 	}
 
-	return nil
+	m.qmu.Lock()
+	m.queue = m.queue[n:]
+	for _, r := range group[1:] {
+		r.err, r.done = err, true
+		close(r.wake)
+	}
+	if len(m.queue) > 0 {
+		close(m.queue[0].wake)
+	}
+	m.qmu.Unlock()
+	return err
 }
 
 func (m *Memtable) Has(key string) bool {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-
 	// check the memtable
-	return m.data.Has(key)
+	it := m.lookup(key, maxSequence)
+	return it != nil && it.kind != typeDel
 }
 
 func (m *Memtable) Get(key string) ([]byte, error) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-
 	// check the memtable
-	val, ok := m.data.Get(key)
-	if !ok {
+	it := m.lookup(key, maxSequence)
+	if it == nil || it.kind == typeDel {
 		return nil, ErrNotFound
 	}
-	return val, nil
+	return it.val, nil
 }
 
-func (m *Memtable) Del(key string) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+// lookup returns the newest version of key written at or before
+// seq, which may be a tombstone, or nil if there is none. A key
+// covered by a newer range delete is returned as a tombstone.
+func (m *Memtable) lookup(key string, seq uint64) *item {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var it *item
+	ikey, val, ok := m.data.Ceil(seekKey(key, seq))
+	if ok {
+		if e := decodeEntry(ikey, val); e.key == key {
+			it = &e
+		}
+	}
+	return shadow(it, key, coveringSeq(m.rangeDels, key, seq))
+}
 
-	// write del entry to the logfile
-	err := m.wal.WriteDel(key)
+// Write applies every write in b atomically, logging them as a
+// single record
+func (m *Memtable) Write(b *WriteBatch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+	err := m.commit(b.record())
 	if err != nil {
-		return fmt.Errorf("[Memtable.Del] calling WriteDel: %v", err)
+		return fmt.Errorf("[Memtable.Write] calling commit: %v", err)
 	}
+	return nil
+}
 
-	// remove entry from the memtable
-	m.data.Del(key)
-	s := m.data.Size()
-
-	// update size (if need be)
-	if s < m.size {
-		m.size -= s
+// Del records a tombstone for key. The tombstone is kept in the
+// memtable and flushed to the sstable so that it keeps shadowing
+// any older version of the key stored in an older sstable.
+func (m *Memtable) Del(key string) error {
+	// write del entry to the logfile and replace
+	// the entry in the memtable with a tombstone
+	err := m.commit(NewDataRecord(typeDel, 0, key, nil))
+	if err != nil {
+		return fmt.Errorf("[Memtable.Del] calling commit: %v", err)
 	}
 	return nil
 }
@@ -138,49 +272,41 @@ func (m *Memtable) Size() int64 {
 	return m.size
 }
 
+// Len returns the number of versions and range deletes held,
+// counting every write to the same key separately
+func (m *Memtable) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.data.Len() + len(m.rangeDels)
+}
+
 func (m *Memtable) ShouldFlush() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	if m.size > m.threshold-m.threshold/10 {
 		return true
 	}
 	return false
 }
 
-func (m *Memtable) Flush() error {
+// Flush writes the contents of the memtable out to a new sstable
+// file at path and then resets the memtable and its log file.
+func (m *Memtable) Flush(path string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	// create new sstable file
-	filename := fmt.Sprintf("dat-%d.sst", time.Now().Unix())
-	fd, err := openOrCreate(filename)
-	if err != nil {
-		return fmt.Errorf("[Memtable.Flush] calling OpenOrCreate: %v", err)
-	}
-	defer fd.Close()
-
-	// iterate all of the entries in the memtable in order
-	m.data.ScanFront(func(key string, value []byte) bool {
-		// write each entry to the sstable file
-		err = writeEntry(fd, key, value)
-		if err != nil {
-			return false
-		}
-		return true
-	})
+	err := m.writeTable(path, nil)
 	if err != nil {
-		return fmt.Errorf("[Memtable.Flush] scanning front (i think): %v", err)
-	}
-	// make sure file is flushed to disk
-	err = fd.Sync()
-	if err != nil {
-		return fmt.Errorf("[Memtable.Flush] calling fd.Sync: %v", err)
+		return fmt.Errorf("[Memtable.Flush] calling writeTable: %v", err)
 	}
 
 	// reset the memtable data
 	m.data.Close()
 	m.data = rbtree.NewRBTree()
+	m.rangeDels, m.delsSize = nil, 0
 
 	// get the log file name
-	path := m.wal.file.Name()
+	path = m.wal.file.Name()
 
 	// close and remove the existing log file
 	// we don't need this one anymore
@@ -205,6 +331,43 @@ func (m *Memtable) Flush() error {
 	return nil
 }
 
+// writeTable writes the contents of the memtable out to a new
+// sstable file at path, leaving the memtable and its log as is.
+// The caller must hold at least a read lock.
+func (m *Memtable) writeTable(path string, opts *TableOptions) error {
+	// create new sstable file
+	w, err := NewSSTableWriter(path, opts)
+	if err != nil {
+		return fmt.Errorf("[Memtable.writeTable] calling NewSSTableWriter: %v", err)
+	}
+
+	// iterate all of the entries in the memtable in order
+	m.data.ScanFront(func(ikey string, value []byte) bool {
+		// write each version (or tombstone) to the sstable file
+		it := decodeEntry(ikey, value)
+		err = w.add(it.key, it.seq, it.kind, it.val)
+		if err != nil {
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		w.Abort()
+		return fmt.Errorf("[Memtable.writeTable] writing sstable entry: %v", err)
+	}
+	for _, d := range m.rangeDels {
+		w.addRangeDel(d)
+	}
+	// write the index and footer and make sure
+	// the file is flushed to disk
+	err = w.Close()
+	if err != nil {
+		w.Abort()
+		return fmt.Errorf("[Memtable.writeTable] calling w.Close: %v", err)
+	}
+	return nil
+}
+
 func (m *Memtable) Close() error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -215,3 +378,74 @@ func (m *Memtable) Close() error {
 	m.data.Close()
 	return nil
 }
+
+// floor returns an item for the greatest key less than or equal
+// to key (or strictly less than key if strict is set). It is the
+// oldest version held of that key, whether visible or not.
+func (m *Memtable) floor(key string, strict bool) *item {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var k string
+	var v []byte
+	var ok bool
+	if strict {
+		k, v, ok = m.data.Prev(seekKey(key, maxSequence))
+	} else {
+		k, v, ok = m.data.Floor(makeInternalKey(key, 0, 0))
+	}
+	if !ok {
+		return nil
+	}
+	it := decodeEntry(k, v)
+	return &it
+}
+
+// last returns an item for the greatest key, as floor does
+func (m *Memtable) last() *item {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	k, v, ok := m.data.Max()
+	if !ok {
+		return nil
+	}
+	it := decodeEntry(k, v)
+	return &it
+}
+
+// iter returns an iterator over every version held in the memtable
+func (m *Memtable) iter() iterator {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return &memIterator{m: m, data: m.data}
+}
+
+// NewIterator returns an Iterator over the memtable as it is now,
+// limited to the keys opts allows. It reads the tree in place, writes
+// made after it was created are not seen through it.
+func (m *Memtable) NewIterator(opts *IterOptions) Iterator {
+	seq := m.lastApplied()
+	v := newVisibleIterator(m.iter(), seq, newRangeDelSet(m.rangeDelsAt(seq), seq))
+	v.lower, v.upper = opts.bounds()
+	return &dbIterator{v: v}
+}
+
+// rangeDelsAt returns a copy of the range deletes written at or before seq
+func (m *Memtable) rangeDelsAt(seq uint64) []rangeDel {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var dels []rangeDel
+	for _, d := range m.rangeDels {
+		if d.seq <= seq {
+			dels = append(dels, d)
+		}
+	}
+	return dels
+}
+
+// decodeEntry turns an entry of the rbtree back into an item. The
+// memtable only ever holds keys made by makeInternalKey, so they
+// always parse.
+func decodeEntry(ikey string, val []byte) item {
+	key, seq, kind, _ := parseInternalKey(ikey)
+	return item{key: key, seq: seq, kind: kind, val: val}
+}
@@ -0,0 +1,249 @@
+package lsm
+
+import "time"
+
+// Options holds the tunables used when opening an LSMTree. Any
+// field left at its zero value is replaced by the matching value
+// from DefaultOptions.
+type Options struct {
+	// MemtableSize is the number of bytes the active memtable
+	// may hold before it is flushed to a new sstable
+	MemtableSize int64
+
+	// WALRecovery controls how corrupt records found while
+	// replaying the write ahead log on open are handled
+	WALRecovery RecoveryMode
+
+	// WALSync controls how often the write ahead log is synced to
+	// disk. The zero value syncs before every write returns.
+	WALSync SyncPolicy
+
+	// Compaction decides which sstables are merged together and
+	// when. If it is nil a LeveledCompaction is built from the
+	// leveled compaction options below.
+	Compaction CompactionStrategy
+
+	// L0CompactionTrigger is the number of level 0 tables that
+	// causes them to be compacted into level 1
+	L0CompactionTrigger int
+
+	// BaseLevelSize is the number of bytes level 1 may hold before
+	// it is compacted into level 2. Every level after that may hold
+	// LevelSizeMultiplier times as much as the one before it.
+	BaseLevelSize       int64
+	LevelSizeMultiplier int
+
+	// MaxLevels is the number of levels in the tree
+	MaxLevels int
+
+	// BloomBitsPerKey is the size of the bloom filter written to
+	// each sstable per key. Zero uses the default of 10 bits, which
+	// gives about a one percent false positive rate, and a negative
+	// value disables filters.
+	BloomBitsPerKey int
+
+	// BlockSize is the size sstable data blocks are cut at
+	BlockSize int
+
+	// Compression holds the compressor data blocks are written with
+	// on each level, starting from level 0. Levels past the end use
+	// the last entry, and a nil entry or slice means no compression,
+	// so []Compressor{nil, nil, &FlateCompressor{Level: 6}} leaves
+	// the two busiest levels uncompressed.
+	Compression []Compressor
+
+	// TargetFileSize is the size at which the output of a
+	// compaction is split into a new sstable
+	TargetFileSize int64
+
+	// BlockCacheSize is the number of bytes of sstable blocks kept
+	// in memory, shared by every table. The index and filter blocks
+	// of open tables are pinned in the cache and count towards it.
+	// A negative value disables the cache.
+	BlockCacheSize int64
+
+	// MaxOpenFiles is the number of sstables kept open at once.
+	// Tables are opened when they are first read and the least
+	// recently used ones are closed once there are more than this.
+	MaxOpenFiles int
+
+	// MmapReads maps sstables into memory instead of reading
+	// their blocks with pread, see ReaderOptions.Mmap
+	MmapReads bool
+
+	// Writes are delayed by SlowdownDelay each once any of the
+	// slowdown triggers below is reached, and stopped altogether once
+	// any of the stop triggers is, until flushing and compaction have
+	// caught up. The memtable triggers count sealed memtables waiting
+	// to be flushed, the level 0 triggers count the tables in level 0
+	// and the pending compaction triggers count the bytes reported by
+	// the compaction strategy, if it is a CompactionEstimator. A
+	// negative trigger is never reached. Strategies that keep a lot of
+	// tables in level 0, such as size tiered compaction, may need the
+	// level 0 triggers raised.
+	MemtableSlowdownTrigger        int
+	MemtableStopTrigger            int
+	L0SlowdownTrigger              int
+	L0StopTrigger                  int
+	PendingCompactionSlowdownBytes int64
+	PendingCompactionStopBytes     int64
+	SlowdownDelay                  time.Duration
+
+	// LockTimeout is how long a pessimistic transaction waits for a
+	// key locked by another before giving up with ErrLockTimeout. A
+	// negative value waits for as long as it takes.
+	LockTimeout time.Duration
+
+	// OnWriteStall, if set, is called whenever writes start or stop
+	// being held back. It is called with the tree locked, so it must
+	// return quickly and must not call back into the tree.
+	OnWriteStall func(StallInfo)
+}
+
+// IterOptions limits the keys an Iterator goes over
+type IterOptions struct {
+	// LowerBound is the least key allowed
+	LowerBound string
+
+	// UpperBound, if set, is the key every key
+	// allowed must be less than
+	UpperBound string
+
+	// Prefix, if set, only allows keys starting with it. It
+	// narrows the bounds to the keys with the prefix.
+	Prefix string
+}
+
+// bounds returns the keys opts allows as a range from lower up to,
+// but not including, upper. An empty upper means no bound.
+func (o *IterOptions) bounds() (string, string) {
+	if o == nil {
+		return "", ""
+	}
+	lower, upper := o.LowerBound, o.UpperBound
+	if o.Prefix != "" {
+		if o.Prefix > lower {
+			lower = o.Prefix
+		}
+		if end := prefixEnd(o.Prefix); end != "" && (upper == "" || end < upper) {
+			upper = end
+		}
+	}
+	return lower, upper
+}
+
+// prefixEnd returns the least key greater than every key starting
+// with prefix, or "" if there is none
+func prefixEnd(prefix string) string {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			return prefix[:i] + string([]byte{prefix[i] + 1})
+		}
+	}
+	return ""
+}
+
+var DefaultOptions = Options{
+	MemtableSize:        4 << 20,
+	L0CompactionTrigger: 4,
+	BaseLevelSize:       10 << 20,
+	LevelSizeMultiplier: 10,
+	MaxLevels:           7,
+	BlockSize:           4 << 10,
+	TargetFileSize:      2 << 20,
+	BlockCacheSize:      8 << 20,
+	MaxOpenFiles:        defaultMaxOpenFiles,
+
+	MemtableSlowdownTrigger:        3,
+	MemtableStopTrigger:            4,
+	L0SlowdownTrigger:              20,
+	L0StopTrigger:                  36,
+	PendingCompactionSlowdownBytes: 256 << 20,
+	PendingCompactionStopBytes:     1 << 30,
+	SlowdownDelay:                  time.Millisecond,
+
+	LockTimeout: time.Second,
+}
+
+func (o *Options) withDefaults() *Options {
+	opts := DefaultOptions
+	if o != nil {
+		opts.override(o)
+	}
+	if opts.Compaction == nil {
+		opts.Compaction = &LeveledCompaction{
+			L0Trigger:     opts.L0CompactionTrigger,
+			BaseLevelSize: opts.BaseLevelSize,
+			Multiplier:    opts.LevelSizeMultiplier,
+			MaxLevels:     opts.MaxLevels,
+		}
+	}
+	return &opts
+}
+
+// override replaces the fields of opts with
+// every field of o that is not a zero value
+func (opts *Options) override(o *Options) {
+	if o.MemtableSize > 0 {
+		opts.MemtableSize = o.MemtableSize
+	}
+	if o.L0CompactionTrigger > 0 {
+		opts.L0CompactionTrigger = o.L0CompactionTrigger
+	}
+	if o.BaseLevelSize > 0 {
+		opts.BaseLevelSize = o.BaseLevelSize
+	}
+	if o.LevelSizeMultiplier > 1 {
+		opts.LevelSizeMultiplier = o.LevelSizeMultiplier
+	}
+	if o.MaxLevels > 1 {
+		opts.MaxLevels = o.MaxLevels
+	}
+	if o.BlockSize > 0 {
+		opts.BlockSize = o.BlockSize
+	}
+	if o.TargetFileSize > 0 {
+		opts.TargetFileSize = o.TargetFileSize
+	}
+	if o.BlockCacheSize != 0 {
+		opts.BlockCacheSize = o.BlockCacheSize
+	}
+	if o.MaxOpenFiles > 0 {
+		opts.MaxOpenFiles = o.MaxOpenFiles
+	}
+	if o.BloomBitsPerKey != 0 {
+		opts.BloomBitsPerKey = o.BloomBitsPerKey
+	}
+	if o.Compression != nil {
+		opts.Compression = o.Compression
+	}
+	if o.MemtableSlowdownTrigger != 0 {
+		opts.MemtableSlowdownTrigger = o.MemtableSlowdownTrigger
+	}
+	if o.MemtableStopTrigger != 0 {
+		opts.MemtableStopTrigger = o.MemtableStopTrigger
+	}
+	if o.L0SlowdownTrigger != 0 {
+		opts.L0SlowdownTrigger = o.L0SlowdownTrigger
+	}
+	if o.L0StopTrigger != 0 {
+		opts.L0StopTrigger = o.L0StopTrigger
+	}
+	if o.PendingCompactionSlowdownBytes != 0 {
+		opts.PendingCompactionSlowdownBytes = o.PendingCompactionSlowdownBytes
+	}
+	if o.PendingCompactionStopBytes != 0 {
+		opts.PendingCompactionStopBytes = o.PendingCompactionStopBytes
+	}
+	if o.SlowdownDelay > 0 {
+		opts.SlowdownDelay = o.SlowdownDelay
+	}
+	if o.LockTimeout != 0 {
+		opts.LockTimeout = o.LockTimeout
+	}
+	opts.OnWriteStall = o.OnWriteStall
+	opts.MmapReads = o.MmapReads
+	opts.Compaction = o.Compaction
+	opts.WALRecovery = o.WALRecovery
+	opts.WALSync = o.WALSync
+}
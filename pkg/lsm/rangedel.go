@@ -0,0 +1,142 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// rangeDel deletes every key from start up to, but not including,
+// end that was written before seq. Range deletes are kept apart from
+// the versions of keys, in the memtable and in sstables alike, and
+// shadow any older version of a key they cover.
+type rangeDel struct {
+	start string
+	end   string
+	seq   uint64
+}
+
+func (d *rangeDel) covers(key string) bool {
+	return d.start <= key && key < d.end
+}
+
+// last returns the largest key a table holding d claims to cover. The
+// end of the range is not covered, but the key just before it can only
+// be named when the end is some key followed by a zero byte, as it is
+// for range deletes cut at the edge of a table. Otherwise the end is
+// claimed, which is harmless.
+func (d *rangeDel) last() string {
+	if n := len(d.end); n > 0 && d.end[n-1] == 0x00 {
+		return d.end[:n-1]
+	}
+	return d.end
+}
+
+// coveringSeq returns the sequence number of the newest range delete
+// in dels that covers key and was written at or before seq, or zero
+// if there is none
+func coveringSeq(dels []rangeDel, key string, seq uint64) uint64 {
+	var cover uint64
+	for i := range dels {
+		if dels[i].seq <= seq && dels[i].seq > cover && dels[i].covers(key) {
+			cover = dels[i].seq
+		}
+	}
+	return cover
+}
+
+// shadow returns a tombstone for key in place of it, the newest
+// version of key found, if a range delete written at cover is
+// newer. A cover of zero shadows nothing.
+func shadow(it *item, key string, cover uint64) *item {
+	if cover > 0 && (it == nil || it.seq < cover) {
+		return &item{key: key, seq: cover, kind: typeDel}
+	}
+	return it
+}
+
+// rangeDelSet answers which range deletes cover a key while iterating.
+// The range deletes it is made from are cut up into fragments that do
+// not overlap, sorted by key, each holding the newest sequence number
+// of those covering it.
+type rangeDelSet struct {
+	frags []rangeDel
+}
+
+// newRangeDelSet returns the set of range deletes in dels that were
+// written at or before seq
+func newRangeDelSet(dels []rangeDel, seq uint64) *rangeDelSet {
+	var bounds []string
+	for _, d := range dels {
+		if d.seq <= seq && d.start < d.end {
+			bounds = append(bounds, d.start, d.end)
+		}
+	}
+	sort.Strings(bounds)
+	s := new(rangeDelSet)
+	for i := 0; i+1 < len(bounds); i++ {
+		start, end := bounds[i], bounds[i+1]
+		if start == end {
+			continue
+		}
+		cover := coveringSeq(dels, start, seq)
+		if cover == 0 {
+			continue
+		}
+		if n := len(s.frags); n > 0 && s.frags[n-1].end == start && s.frags[n-1].seq == cover {
+			s.frags[n-1].end = end
+			continue
+		}
+		s.frags = append(s.frags, rangeDel{start: start, end: end, seq: cover})
+	}
+	return s
+}
+
+// covering returns the sequence number of the newest range
+// delete in the set that covers key, or zero if there is none
+func (s *rangeDelSet) covering(key string) uint64 {
+	if s == nil {
+		return 0
+	}
+	i := sort.Search(len(s.frags), func(i int) bool {
+		return s.frags[i].end > key
+	})
+	if i < len(s.frags) && s.frags[i].covers(key) {
+		return s.frags[i].seq
+	}
+	return 0
+}
+
+// appendRangeDels encodes dels as an sstable range delete block
+func appendRangeDels(b []byte, dels []rangeDel) []byte {
+	for _, d := range dels {
+		b = appendString(b, d.start)
+		b = appendString(b, d.end)
+		b = binary.AppendUvarint(b, d.seq)
+	}
+	return b
+}
+
+// readRangeDels decodes an sstable range delete block
+func readRangeDels(b []byte) ([]rangeDel, error) {
+	var dels []rangeDel
+	for len(b) > 0 {
+		var d rangeDel
+		var err error
+		d.start, b, err = readString(b)
+		if err != nil {
+			return nil, err
+		}
+		d.end, b, err = readString(b)
+		if err != nil {
+			return nil, err
+		}
+		var n int
+		d.seq, n = binary.Uvarint(b)
+		if n <= 0 {
+			return nil, ErrCorrupt
+		}
+		b = b[n:]
+		dels = append(dels, d)
+	}
+	return dels, nil
+}
@@ -27,13 +27,11 @@ func isempty(e entry) bool {
 	return e.key == ""
 }
 
+// compare orders entries by plain byte-wise comparison of
+// their keys. The lsm package relies on ScanFront returning
+// keys in this order when writing sstables, so it must match
+// the ordering used by the sstable index.
 func compare(this, that entry) int {
-	if len(this.key) < len(that.key) {
-		return -1
-	}
-	if len(this.key) > len(that.key) {
-		return +1
-	}
 	if this.key < that.key {
 		return -1
 	}
@@ -197,6 +195,45 @@ func (t *rbTree) Max() (string, []byte, bool) {
 	return x.entry.key, x.entry.value, true
 }
 
+// Floor returns the entry with the greatest key that is
+// less than or equal to the provided key, if one exists.
+func (t *rbTree) Floor(key string) (string, []byte, bool) {
+	x := t.floor(entry{key: key})
+	if x == t.NIL {
+		return "", nil, false
+	}
+	return x.entry.key, x.entry.value, true
+}
+
+// Prev returns the entry with the greatest key that is
+// strictly less than the provided key, if one exists.
+func (t *rbTree) Prev(key string) (string, []byte, bool) {
+	ret := t.NIL
+	x := t.root
+	for x != t.NIL {
+		if compare(x.entry, entry{key: key}) == -1 {
+			ret = x
+			x = x.right
+		} else {
+			x = x.left
+		}
+	}
+	if ret == t.NIL {
+		return "", nil, false
+	}
+	return ret.entry.key, ret.entry.value, true
+}
+
+// Ceil returns the entry with the least key that is
+// greater than or equal to the provided key, if one exists.
+func (t *rbTree) Ceil(key string) (string, []byte, bool) {
+	x := t.ceil(entry{key: key})
+	if x == t.NIL {
+		return "", nil, false
+	}
+	return x.entry.key, x.entry.value, true
+}
+
 type Iterator func(key string, value []byte) bool
 
 func (t *rbTree) ScanFront(iter Iterator) {
@@ -410,6 +447,40 @@ func (t *rbTree) max(x *rbNode) *rbNode {
 	return x
 }
 
+func (t *rbTree) floor(e entry) *rbNode {
+	ret := t.NIL
+	x := t.root
+	for x != t.NIL {
+		switch compare(x.entry, e) {
+		case 0:
+			return x
+		case -1:
+			ret = x
+			x = x.right
+		default:
+			x = x.left
+		}
+	}
+	return ret
+}
+
+func (t *rbTree) ceil(e entry) *rbNode {
+	ret := t.NIL
+	x := t.root
+	for x != t.NIL {
+		switch compare(x.entry, e) {
+		case 0:
+			return x
+		case 1:
+			ret = x
+			x = x.left
+		default:
+			x = x.right
+		}
+	}
+	return ret
+}
+
 func (t *rbTree) successor(x *rbNode) *rbNode {
 	if x == t.NIL {
 		return t.NIL
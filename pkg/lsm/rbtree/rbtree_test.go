@@ -203,6 +203,70 @@ func TestRbTree_Max(t *testing.T) {
 	tree.Close()
 }
 
+// signature: Floor(key string) (string, []byte, bool)
+func TestRbTree_Floor(t *testing.T) {
+	tree := NewRBTree()
+	for i := 0; i < n*thousand; i += 2 {
+		tree.Put(makeKey(i), makeVal(i))
+	}
+	k, _, ok := tree.Floor(makeKey(10))
+	if !ok {
+		t.Errorf("floor: %v", ok)
+	}
+	util.AssertEqual(t, makeKey(10), k)
+	k, _, ok = tree.Floor(makeKey(11))
+	if !ok {
+		t.Errorf("floor: %v", ok)
+	}
+	util.AssertEqual(t, makeKey(10), k)
+	_, _, ok = tree.Floor("a")
+	if ok {
+		t.Errorf("floor: %v", ok)
+	}
+	tree.Close()
+}
+
+// signature: Prev(key string) (string, []byte, bool)
+func TestRbTree_Prev(t *testing.T) {
+	tree := NewRBTree()
+	for i := 0; i < n*thousand; i += 2 {
+		tree.Put(makeKey(i), makeVal(i))
+	}
+	k, _, ok := tree.Prev(makeKey(10))
+	if !ok {
+		t.Errorf("prev: %v", ok)
+	}
+	util.AssertEqual(t, makeKey(8), k)
+	_, _, ok = tree.Prev(makeKey(0))
+	if ok {
+		t.Errorf("prev: %v", ok)
+	}
+	tree.Close()
+}
+
+// signature: Ceil(key string) (string, []byte, bool)
+func TestRbTree_Ceil(t *testing.T) {
+	tree := NewRBTree()
+	for i := 0; i < n*thousand; i += 2 {
+		tree.Put(makeKey(i), makeVal(i))
+	}
+	k, _, ok := tree.Ceil(makeKey(10))
+	if !ok {
+		t.Errorf("ceil: %v", ok)
+	}
+	util.AssertEqual(t, makeKey(10), k)
+	k, _, ok = tree.Ceil(makeKey(11))
+	if !ok {
+		t.Errorf("ceil: %v", ok)
+	}
+	util.AssertEqual(t, makeKey(12), k)
+	_, _, ok = tree.Ceil("z")
+	if ok {
+		t.Errorf("ceil: %v", ok)
+	}
+	tree.Close()
+}
+
 // signature: ScanFront(iter Iterator)
 func TestRbTree_ScanFront(t *testing.T) {
 	tree := NewRBTree()
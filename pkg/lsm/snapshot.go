@@ -0,0 +1,123 @@
+package lsm
+
+import (
+	"container/list"
+	"sort"
+)
+
+// Snapshot is a read only view of a tree as of the moment it was
+// taken. Writes made after that are not seen through it, and every
+// version it can see is kept through compaction until it is released.
+// A snapshot must not be read from once it has been released.
+type Snapshot struct {
+	t    *LSMTree
+	seq  uint64        // sequence number of the last write seen
+	elem *list.Element // position in the list of live snapshots, nil once released
+}
+
+// NewSnapshot takes a snapshot of the tree, which should be released
+// as soon as it is no longer needed so that compaction can let go of
+// the versions it holds on to
+func (t *LSMTree) NewSnapshot() *Snapshot {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	s := &Snapshot{t: t, seq: t.mem.lastApplied()}
+	t.snapMu.Lock()
+	s.elem = t.snapshots.PushBack(s)
+	t.snapMu.Unlock()
+	return s
+}
+
+// snapshotSeqs returns the sequence numbers of the live
+// snapshots, oldest first and without repeats
+func (t *LSMTree) snapshotSeqs() []uint64 {
+	t.snapMu.Lock()
+	seqs := make([]uint64, 0, t.snapshots.Len())
+	for e := t.snapshots.Front(); e != nil; e = e.Next() {
+		seqs = append(seqs, e.Value.(*Snapshot).seq)
+	}
+	t.snapMu.Unlock()
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	n := 0
+	for i, seq := range seqs {
+		if i == 0 || seq != seqs[n-1] {
+			seqs[n] = seq
+			n++
+		}
+	}
+	return seqs[:n]
+}
+
+// Release releases the snapshot. Calling it more than once is fine.
+func (s *Snapshot) Release() {
+	s.t.snapMu.Lock()
+	defer s.t.snapMu.Unlock()
+	if s.elem != nil {
+		s.t.snapshots.Remove(s.elem)
+		s.elem = nil
+	}
+}
+
+func (s *Snapshot) Has(k string) bool {
+	_, err := s.Get(k)
+	return err == nil
+}
+
+func (s *Snapshot) Get(k string) ([]byte, error) {
+	s.t.mu.RLock()
+	defer s.t.mu.RUnlock()
+	return s.t.get(k, s.seq)
+}
+
+func (s *Snapshot) GetEntry(k string) (*Entry, error) {
+	v, err := s.Get(k)
+	if err != nil {
+		return nil, err
+	}
+	return &Entry{Key: k, Value: v}, nil
+}
+
+func (s *Snapshot) Lower(k string) (*Entry, error) {
+	s.t.mu.RLock()
+	defer s.t.mu.RUnlock()
+	return s.t.lower(k, true, s.seq)
+}
+
+func (s *Snapshot) Higher(k string) (*Entry, error) {
+	s.t.mu.RLock()
+	defer s.t.mu.RUnlock()
+	return s.t.higher(k, s.seq)
+}
+
+func (s *Snapshot) First() (*Entry, error) {
+	return s.Higher("")
+}
+
+func (s *Snapshot) Last() (*Entry, error) {
+	s.t.mu.RLock()
+	defer s.t.mu.RUnlock()
+	return s.t.lower("", false, s.seq)
+}
+
+func (s *Snapshot) Count() (int64, error) {
+	s.t.mu.RLock()
+	defer s.t.mu.RUnlock()
+	return s.t.count(s.seq)
+}
+
+// NewIterator returns an Iterator over the snapshot limited to the
+// keys opts allows, which must be closed before the snapshot is released
+func (s *Snapshot) NewIterator(opts *IterOptions) Iterator {
+	s.t.mu.RLock()
+	defer s.t.mu.RUnlock()
+	return s.t.newIterator(s.seq, opts)
+}
+
+// Iter calls fn for every entry in the snapshot in key order until
+// fn returns false. The tree is read locked for the duration of the
+// call, so fn must not write to the tree.
+func (s *Snapshot) Iter(fn func(k string, v []byte) bool) {
+	s.t.mu.RLock()
+	defer s.t.mu.RUnlock()
+	s.t.scan(s.seq, fn)
+}
@@ -0,0 +1,91 @@
+package lsm
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	db := openTestTree(t, t.TempDir())
+	defer db.Close()
+	for i := 0; i < 1000; i++ {
+		if err := db.Put(makeKey(i), makeVal(i)); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+	}
+	snap := db.NewSnapshot()
+	defer snap.Release()
+	// overwrite, delete and add keys behind its back
+	for i := 0; i < 1000; i++ {
+		var err error
+		switch i % 3 {
+		case 0:
+			err = db.Put(makeKey(i), []byte("new"))
+		case 1:
+			_, err = db.Del(makeKey(i))
+		}
+		if err == nil {
+			err = db.Put(makeKey(i+1000), makeVal(i))
+		}
+		if err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	check := func(when string) {
+		t.Helper()
+		for i := 0; i < 2000; i++ {
+			v, err := snap.Get(makeKey(i))
+			if i < 1000 && (err != nil || !bytes.Equal(v, makeVal(i))) {
+				t.Fatalf("%s: get %q: got %q (%v), want %q", when, makeKey(i), v, err, makeVal(i))
+			}
+			if i >= 1000 && snap.Has(makeKey(i)) {
+				t.Fatalf("%s: has %q: expected a key written after the snapshot to be missing", when, makeKey(i))
+			}
+		}
+		var n int
+		snap.Iter(func(k string, v []byte) bool {
+			if k != makeKey(n) || !bytes.Equal(v, makeVal(n)) {
+				t.Fatalf("%s: iter: got %q=%q at %d", when, k, v, n)
+			}
+			n++
+			return true
+		})
+		if c, err := snap.Count(); n != 1000 || c != 1000 {
+			t.Fatalf("%s: got %d entries iterating, count %d (%v), want 1000", when, n, c, err)
+		}
+		if e, err := snap.Last(); err != nil || e.Key != makeKey(999) {
+			t.Fatalf("%s: last: got %v (%v)", when, e, err)
+		}
+		if e, err := snap.Lower(makeKey(1500)); err != nil || e.Key != makeKey(999) {
+			t.Fatalf("%s: lower: got %v (%v)", when, e, err)
+		}
+		if e, err := snap.Higher(makeKey(1)); err != nil || e.Key != makeKey(1) {
+			t.Fatalf("%s: higher: got %v (%v)", when, e, err)
+		}
+		// while the tree itself moves on
+		if n, err := db.Count(); err != nil || n != 1000+667 {
+			t.Fatalf("%s: tree count: got %d (%v), want %d", when, n, err, 1000+667)
+		}
+	}
+	check("before compaction")
+	if err := db.Flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	check("after compaction")
+
+	// once released compaction drops what only it could see
+	snap.Release()
+	if err := db.Compact(); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	var entries int64
+	for _, meta := range db.live {
+		entries += tableReader(t, db, meta.num).table.count
+	}
+	if entries != 1000+667 {
+		t.Fatalf("got %d entries in tables after release, want %d", entries, 1000+667)
+	}
+}
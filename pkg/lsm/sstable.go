@@ -1,5 +1,913 @@
 package lsm
 
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+)
+
+// SSTable file layout (all fixed width integers are little endian)
+//
+//	+---------------------+
+//	| data block 0        |
+//	| ...                 |
+//	| data block n-1      |
+//	+---------------------+
+//	| filter block        |
+//	+---------------------+
+//	| range delete block  |
+//	+---------------------+
+//	| meta block          |
+//	+---------------------+
+//	| index block         |
+//	+---------------------+
+//	| footer (48 bytes)   |
+//	+---------------------+
+//
+// data block:
+//	entries sorted by key with prefix compressed keys and
+//	restart points, see blockBuilder. a block is cut once it
+//	grows past the target block size. each entry has a kind,
+//	typePut for a live value or typeDel for a tombstone, which
+//	has no value and shadows any older version of the key.
+//	keys are internal keys, see makeInternalKey, so a table
+//	can hold several versions of a key, newest first.
+//
+//	on disk every data block is followed by a trailer of
+//	codec u8 | crc u32
+//	where codec is the ID of the Compressor the block was
+//	written with and crc is the CRC32C of the stored block
+//	and the codec byte. blocks that do not shrink by at least
+//	an eighth are stored uncompressed.
+//
+// filter block:
+//	a bloom filter over every user key in the table, see bloomFilter.
+//	it is empty if the table was written without a filter.
+//
+// range delete block:
+//	repeated { startlen uvarint | start | endlen uvarint | end | seq uvarint }
+//	for every range delete in the table, see rangeDel. the key
+//	range of the table is widened to cover them.
+//
+// meta block:
+//	count uvarint | smallest keylen uvarint | smallest user key |
+//	largest keylen uvarint | largest user key |
+//	filter offset uvarint | filter size uvarint |
+//	range delete offset uvarint | range delete size uvarint
+//
+// index block:
+//	repeated { keylen uvarint | last internal key in block | offset uvarint | size uvarint }
+//
+// footer:
+//	meta offset u64 | meta size u64 | index offset u64 | index size u64 |
+//	version u32 | reserved u32 | magic u64
+//
+// A reader loads the footer, meta and index blocks when the table
+// is opened and then only has to read a single data block for any
+// point lookup, and none at all when the filter rules the key out.
+
+const (
+	sstableMagic     = 0x4c534d5453535442 // "LSMTSSTB"
+	sstableVersion   = 8
+	sstableFooterLen = 48
+	defaultBlockSize = 4 << 10
+	blockTrailerLen  = 5
+)
+
+var (
+	ErrBadMagic   = errors.New("sstable: bad magic number")
+	ErrBadVersion = errors.New("sstable: unsupported format version")
+	ErrCorrupt    = errors.New("sstable: corrupt table")
+	ErrKeyOrder   = errors.New("sstable: keys must be added in increasing order")
+)
+
+// SSTable describes an immutable, sorted table file on disk
 type SSTable struct {
-	// TODO: make this a thing
+	path     string
+	size     int64
+	count    int64
+	smallest string
+	largest  string
+}
+
+func (t *SSTable) Path() string     { return t.path }
+func (t *SSTable) Size() int64      { return t.size }
+func (t *SSTable) Count() int64     { return t.count }
+func (t *SSTable) Smallest() string { return t.smallest }
+func (t *SSTable) Largest() string  { return t.largest }
+
+// blockHandle points at a block within a table file
+type blockHandle struct {
+	offset uint64
+	size   uint64
+}
+
+type indexEntry struct {
+	lastKey string
+	handle  blockHandle
+}
+
+// TableOptions controls how sstables are written
+type TableOptions struct {
+	// BitsPerKey is the size of the bloom filter written for
+	// each key. Zero uses the default of 10, and a negative
+	// value writes tables without a filter.
+	BitsPerKey int
+
+	// BlockSize is the size data blocks are cut at. Zero
+	// uses the default of 4KB.
+	BlockSize int
+
+	// RestartInterval is the number of keys between restart
+	// points in a data block. Zero uses the default of 16.
+	RestartInterval int
+
+	// Compressor compresses data blocks. Nil writes
+	// them uncompressed.
+	Compressor Compressor
+}
+
+type SSTableWriter struct {
+	file    *os.File
+	bw      *bufio.Writer
+	path    string
+	opts    TableOptions
+	offset  uint64
+	block   *blockBuilder
+	index   []indexEntry
+	buf     []byte   // compressed block buffer
+	hashes  []uint64 // bloom hashes of every user key written
+	lastKey string   // internal key of the last entry
+	prevKey string   // user key of the last entry
+	dels    []rangeDel
+	meta    SSTable
+}
+
+// NewSSTableWriter creates a new table file at path. Entries must be
+// written in increasing key order, like the output of rbtree.ScanFront.
+// The table is written to a temporary file and only renamed into place
+// by a successful call to Close, if anything fails along the way it
+// must be thrown away with Abort. A nil opts uses the defaults.
+func NewSSTableWriter(path string, opts *TableOptions) (*SSTableWriter, error) {
+	fd, err := openOrCreate(path + ".tmp")
+	if err != nil {
+		return nil, fmt.Errorf("[NewSSTableWriter] calling openOrCreate: %v", err)
+	}
+	err = fd.Truncate(0)
+	if err != nil {
+		fd.Close()
+		os.Remove(fd.Name())
+		return nil, fmt.Errorf("[NewSSTableWriter] truncate: %v", err)
+	}
+	w := &SSTableWriter{
+		file: fd,
+		bw:   bufio.NewWriter(fd),
+		path: path,
+	}
+	if opts != nil {
+		w.opts = *opts
+	}
+	if w.opts.BitsPerKey == 0 {
+		w.opts.BitsPerKey = defaultBitsPerKey
+	}
+	if w.opts.BlockSize <= 0 {
+		w.opts.BlockSize = defaultBlockSize
+	}
+	if w.opts.Compressor == nil {
+		w.opts.Compressor = NoCompression{}
+	}
+	w.block = newBlockBuilder(w.opts.BlockSize, w.opts.RestartInterval)
+	return w, nil
+}
+
+// Write adds a key value pair to the table, with sequence number zero
+func (w *SSTableWriter) Write(key string, val []byte) error {
+	return w.add(key, 0, typePut, val)
+}
+
+// WriteDel adds a tombstone for key to the table, with sequence number zero
+func (w *SSTableWriter) WriteDel(key string) error {
+	return w.add(key, 0, typeDel, nil)
+}
+
+// add adds a version of key to the table. Versions of the same key
+// must be added newest first.
+func (w *SSTableWriter) add(key string, seq uint64, kind byte, val []byte) error {
+	ikey := makeInternalKey(key, seq, kind)
+	if w.meta.count > 0 && ikey <= w.lastKey {
+		return ErrKeyOrder
+	}
+	w.block.add(ikey, kind, val)
+	if w.opts.BitsPerKey > 0 && (w.meta.count == 0 || key != w.prevKey) {
+		w.hashes = append(w.hashes, bloomHash(key))
+	}
+	w.widen(key, key)
+	w.meta.count++
+	w.lastKey, w.prevKey = ikey, key
+	if w.block.size() >= w.opts.BlockSize {
+		return w.flushBlock()
+	}
+	return nil
+}
+
+// addRangeDel adds a range delete to the table. Range deletes
+// may be added at any point, in any order.
+func (w *SSTableWriter) addRangeDel(d rangeDel) {
+	w.widen(d.start, d.last())
+	w.dels = append(w.dels, d)
+}
+
+// widen widens the key range of the table to cover lo to hi
+func (w *SSTableWriter) widen(lo, hi string) {
+	empty := w.meta.count == 0 && len(w.dels) == 0
+	if empty || lo < w.meta.smallest {
+		w.meta.smallest = lo
+	}
+	if empty || hi > w.meta.largest {
+		w.meta.largest = hi
+	}
+}
+
+// Size returns roughly how many bytes the table will take up
+// on disk if it were closed now, not counting the index
+func (w *SSTableWriter) Size() int64 {
+	return int64(w.offset) + int64(w.block.size())
+}
+
+func (w *SSTableWriter) flushBlock() error {
+	if w.block.empty() {
+		return nil
+	}
+	data, err := w.compressBlock(w.block.finish())
+	if err != nil {
+		return fmt.Errorf("[SSTableWriter.flushBlock] calling compressBlock: %v", err)
+	}
+	h, err := w.writeBlock(data)
+	if err != nil {
+		return fmt.Errorf("[SSTableWriter.flushBlock] calling writeBlock: %v", err)
+	}
+	w.index = append(w.index, indexEntry{lastKey: w.lastKey, handle: h})
+	w.block.reset()
+	return nil
+}
+
+// compressBlock compresses a finished data block and adds its trailer
+func (w *SSTableWriter) compressBlock(raw []byte) ([]byte, error) {
+	c := w.opts.Compressor
+	data, err := c.Compress(w.buf[:0], raw)
+	if err != nil {
+		return nil, err
+	}
+	if c.ID() != NoCompressionID && len(data) > len(raw)-len(raw)/8 {
+		// not worth paying to decompress it
+		c = NoCompression{}
+		data = append(data[:0], raw...)
+	}
+	data = append(data, c.ID())
+	data = binary.LittleEndian.AppendUint32(data, crc32.Checksum(data, crcTable))
+	w.buf = data
+	return data, nil
+}
+
+func (w *SSTableWriter) writeBlock(data []byte) (blockHandle, error) {
+	h := blockHandle{offset: w.offset, size: uint64(len(data))}
+	_, err := w.bw.Write(data)
+	if err != nil {
+		return h, err
+	}
+	w.offset += uint64(len(data))
+	return h, nil
+}
+
+// Close writes out the meta block, index block and footer, syncs the
+// file and atomically moves it to its final path.
+func (w *SSTableWriter) Close() error {
+	err := w.flushBlock()
+	if err != nil {
+		return fmt.Errorf("[SSTableWriter.Close] flushing last block: %v", err)
+	}
+	// write filter block
+	var filter []byte
+	if w.opts.BitsPerKey > 0 {
+		filter = newBloomFilter(w.hashes, w.opts.BitsPerKey)
+	}
+	fh, err := w.writeBlock(filter)
+	if err != nil {
+		return fmt.Errorf("[SSTableWriter.Close] writing filter block: %v", err)
+	}
+	// write range delete block
+	rh, err := w.writeBlock(appendRangeDels(nil, w.dels))
+	if err != nil {
+		return fmt.Errorf("[SSTableWriter.Close] writing range delete block: %v", err)
+	}
+	// write meta block
+	var meta []byte
+	meta = binary.AppendUvarint(meta, uint64(w.meta.count))
+	meta = appendString(meta, w.meta.smallest)
+	meta = appendString(meta, w.meta.largest)
+	meta = binary.AppendUvarint(meta, fh.offset)
+	meta = binary.AppendUvarint(meta, fh.size)
+	meta = binary.AppendUvarint(meta, rh.offset)
+	meta = binary.AppendUvarint(meta, rh.size)
+	mh, err := w.writeBlock(meta)
+	if err != nil {
+		return fmt.Errorf("[SSTableWriter.Close] writing meta block: %v", err)
+	}
+	// write index block
+	var index []byte
+	for _, e := range w.index {
+		index = appendString(index, e.lastKey)
+		index = binary.AppendUvarint(index, e.handle.offset)
+		index = binary.AppendUvarint(index, e.handle.size)
+	}
+	ih, err := w.writeBlock(index)
+	if err != nil {
+		return fmt.Errorf("[SSTableWriter.Close] writing index block: %v", err)
+	}
+	// write footer
+	var footer [sstableFooterLen]byte
+	binary.LittleEndian.PutUint64(footer[0:8], mh.offset)
+	binary.LittleEndian.PutUint64(footer[8:16], mh.size)
+	binary.LittleEndian.PutUint64(footer[16:24], ih.offset)
+	binary.LittleEndian.PutUint64(footer[24:32], ih.size)
+	binary.LittleEndian.PutUint32(footer[32:36], sstableVersion)
+	binary.LittleEndian.PutUint64(footer[40:48], sstableMagic)
+	_, err = w.writeBlock(footer[:])
+	if err != nil {
+		return fmt.Errorf("[SSTableWriter.Close] writing footer: %v", err)
+	}
+	err = w.bw.Flush()
+	if err != nil {
+		return fmt.Errorf("[SSTableWriter.Close] flushing buffer: %v", err)
+	}
+	err = w.file.Sync()
+	if err != nil {
+		return fmt.Errorf("[SSTableWriter.Close] calling file.Sync: %v", err)
+	}
+	err = w.file.Close()
+	if err != nil {
+		return fmt.Errorf("[SSTableWriter.Close] calling file.Close: %v", err)
+	}
+	err = os.Rename(w.file.Name(), w.path)
+	if err != nil {
+		return fmt.Errorf("[SSTableWriter.Close] calling os.Rename: %v", err)
+	}
+	return nil
+}
+
+// Abort gives up on the table, closing and removing its temporary
+// file. It is safe to call after Close has failed.
+func (w *SSTableWriter) Abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+// ReaderOptions controls how sstables are read
+type ReaderOptions struct {
+	// Cache caches the blocks read from the table, and holds its
+	// index and filter blocks pinned for as long as it is open.
+	// Nil reads every block from the file.
+	Cache *BlockCache
+
+	// FileNum identifies the table in the cache and must be
+	// unique among the tables sharing it
+	FileNum uint64
+
+	// Mmap maps the table into memory, so that blocks are read in
+	// place rather than copied out of the file. Values handed out
+	// by the reader are still copied, so none of them refer to the
+	// mapping once it is gone. If the file cannot be mapped it is
+	// read with pread as usual.
+	Mmap bool
+}
+
+type SSTableReader struct {
+	file     *os.File
+	table    SSTable
+	index    []indexEntry
+	filter   bloomFilter     // nil if the table has no filter
+	dels     []rangeDel      // range deletes held in the table
+	counters *filterCounters // shared with other tables by the tree
+	cache    *BlockCache
+	num      uint64
+	pinned   []cacheKey // blocks to unpin on close
+	data     []byte     // the mapped file, nil if reading with pread
+}
+
+// OpenSSTableReader opens the table file at path and loads its
+// footer, meta block and index block into memory. A nil opts
+// reads without a cache.
+func OpenSSTableReader(path string, opts *ReaderOptions) (*SSTableReader, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("[OpenSSTableReader] opening: %v", err)
+	}
+	r := &SSTableReader{file: fd, counters: new(filterCounters)}
+	if opts == nil {
+		opts = new(ReaderOptions)
+	}
+	r.cache, r.num = opts.Cache, opts.FileNum
+	err = r.load(opts.Mmap)
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("[OpenSSTableReader] loading %s: %w", path, err)
+	}
+	return r, nil
+}
+
+func (r *SSTableReader) load(mmap bool) error {
+	fi, err := r.file.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() < sstableFooterLen {
+		return ErrCorrupt
+	}
+	r.table.path = r.file.Name()
+	r.table.size = fi.Size()
+	if mmap {
+		// fall back to pread if the file cannot be mapped
+		r.data, _ = mmapFile(r.file, fi.Size())
+	}
+	footer, err := r.readBlock(blockHandle{
+		offset: uint64(fi.Size() - sstableFooterLen),
+		size:   sstableFooterLen,
+	})
+	if err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint64(footer[40:48]) != sstableMagic {
+		return ErrBadMagic
+	}
+	if binary.LittleEndian.Uint32(footer[32:36]) != sstableVersion {
+		return ErrBadVersion
+	}
+	mh := blockHandle{
+		offset: binary.LittleEndian.Uint64(footer[0:8]),
+		size:   binary.LittleEndian.Uint64(footer[8:16]),
+	}
+	ih := blockHandle{
+		offset: binary.LittleEndian.Uint64(footer[16:24]),
+		size:   binary.LittleEndian.Uint64(footer[24:32]),
+	}
+	// load meta block
+	meta, err := r.readBlock(mh)
+	if err != nil {
+		return err
+	}
+	count, n := binary.Uvarint(meta)
+	if n <= 0 {
+		return ErrCorrupt
+	}
+	r.table.count = int64(count)
+	meta = meta[n:]
+	r.table.smallest, meta, err = readString(meta)
+	if err != nil {
+		return err
+	}
+	r.table.largest, meta, err = readString(meta)
+	if err != nil {
+		return err
+	}
+	// load filter block
+	fh, meta, err := readBlockHandle(meta)
+	if err != nil {
+		return err
+	}
+	if fh.size > 0 {
+		r.filter, err = r.readPinned(fh)
+		if err != nil {
+			return err
+		}
+	}
+	// load range delete block
+	rh, _, err := readBlockHandle(meta)
+	if err != nil {
+		return err
+	}
+	dels, err := r.readBlock(rh)
+	if err != nil {
+		return err
+	}
+	r.dels, err = readRangeDels(dels)
+	if err != nil {
+		return err
+	}
+	// load index block
+	index, err := r.readPinned(ih)
+	if err != nil {
+		return err
+	}
+	for len(index) > 0 {
+		var e indexEntry
+		e.lastKey, index, err = readString(index)
+		if err != nil {
+			return err
+		}
+		e.handle.offset, n = binary.Uvarint(index)
+		if n <= 0 {
+			return ErrCorrupt
+		}
+		index = index[n:]
+		e.handle.size, n = binary.Uvarint(index)
+		if n <= 0 {
+			return ErrCorrupt
+		}
+		index = index[n:]
+		r.index = append(r.index, e)
+	}
+	return nil
+}
+
+// readDataBlock reads the data block at h, checking its trailer
+// and decompressing it if need be
+func (r *SSTableReader) readDataBlock(h blockHandle) ([]byte, error) {
+	if r.cache == nil || r.inPlace(h) {
+		return r.loadDataBlock(h)
+	}
+	k := cacheKey{file: r.num, offset: h.offset}
+	if data, ok := r.cache.get(k); ok {
+		return data, nil
+	}
+	data, err := r.loadDataBlock(h)
+	if err != nil {
+		return nil, err
+	}
+	r.cache.put(k, data)
+	return data, nil
+}
+
+// inPlace reports whether the data block at h is stored as it is
+// in a mapped file, in which case it is read straight out of the
+// mapping. Such blocks are never cached, since the cache may hold
+// on to them after the file has been unmapped.
+func (r *SSTableReader) inPlace(h blockHandle) bool {
+	if r.data == nil {
+		return false
+	}
+	end := h.offset + h.size
+	return h.size >= blockTrailerLen && end <= uint64(len(r.data)) &&
+		r.data[end-blockTrailerLen] == NoCompressionID
+}
+
+// readPinned reads the block at h through the cache, if there is
+// one, and keeps it pinned there until the reader is closed
+func (r *SSTableReader) readPinned(h blockHandle) ([]byte, error) {
+	if r.cache == nil {
+		return r.readBlock(h)
+	}
+	k := cacheKey{file: r.num, offset: h.offset}
+	data, err := r.cache.pin(k, func() ([]byte, error) {
+		b, err := r.readBlock(h)
+		if err != nil {
+			return nil, err
+		}
+		return r.owned(b), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	r.pinned = append(r.pinned, k)
+	return data, nil
+}
+
+func (r *SSTableReader) loadDataBlock(h blockHandle) ([]byte, error) {
+	data, err := r.readBlock(h)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < blockTrailerLen {
+		return nil, ErrCorrupt
+	}
+	n := len(data) - blockTrailerLen
+	if crc32.Checksum(data[:n+1], crcTable) != binary.LittleEndian.Uint32(data[n+1:]) {
+		return nil, ErrCorrupt
+	}
+	if data[n] == NoCompressionID {
+		return data[:n], nil
+	}
+	c, err := lookupCompressor(data[n])
+	if err != nil {
+		return nil, err
+	}
+	raw, err := c.Decompress(nil, data[:n])
+	if err != nil {
+		return nil, fmt.Errorf("%w: decompressing block: %v", ErrCorrupt, err)
+	}
+	return raw, nil
+}
+
+// readBlock returns the raw bytes of the block at h, which refer
+// to the mapped file if there is one
+func (r *SSTableReader) readBlock(h blockHandle) ([]byte, error) {
+	if h.offset+h.size > uint64(r.table.size) || h.offset+h.size < h.offset {
+		return nil, ErrCorrupt
+	}
+	if r.data != nil {
+		return r.data[h.offset : h.offset+h.size : h.offset+h.size], nil
+	}
+	data := make([]byte, h.size)
+	_, err := r.file.ReadAt(data, int64(h.offset))
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Table returns the metadata describing the open table
+func (r *SSTableReader) Table() *SSTable {
+	return &r.table
+}
+
+// Get returns the value for key, or ErrNotFound if the table does
+// not hold the key or holds a tombstone for it. Only the one data
+// block that may contain the key is read from disk.
+func (r *SSTableReader) Get(key string) ([]byte, error) {
+	it, err := r.lookup(key, maxSequence)
+	if err != nil {
+		return nil, fmt.Errorf("[SSTableReader.Get] calling lookup: %w", err)
+	}
+	if it == nil || it.kind == typeDel {
+		return nil, ErrNotFound
+	}
+	return it.val, nil
+}
+
+// lookup returns the newest version of key written at or before
+// seq, which may be a tombstone, or nil if the table holds none.
+// A key covered by a newer range delete is returned as a tombstone.
+// The bloom filter is checked before any data block is read.
+func (r *SSTableReader) lookup(key string, seq uint64) (*item, error) {
+	if key < r.table.smallest || key > r.table.largest {
+		return nil, nil
+	}
+	cover := coveringSeq(r.dels, key, seq)
+	if r.table.count == 0 {
+		return shadow(nil, key, cover), nil
+	}
+	if r.filter != nil {
+		if !r.filter.mayContain(bloomHash(key)) {
+			r.counters.misses.Add(1)
+			return shadow(nil, key, cover), nil
+		}
+		r.counters.hits.Add(1)
+	}
+	it, err := r.search(key, seq)
+	if err != nil {
+		return nil, err
+	}
+	if it == nil && r.filter != nil {
+		absent, err := r.absent(key, seq)
+		if err != nil {
+			return nil, err
+		}
+		if absent {
+			r.counters.falsePositives.Add(1)
+		}
+	}
+	return shadow(r.ownedItem(it), key, cover), nil
+}
+
+// absent reports whether the table holds no version of key at all,
+// once a search as of seq has come up empty. Versions newer than seq
+// do not make a filter hit a false positive.
+func (r *SSTableReader) absent(key string, seq uint64) (bool, error) {
+	if seq == maxSequence {
+		return true, nil
+	}
+	it, err := r.search(key, maxSequence)
+	return it == nil, err
+}
+
+// search reads the data block that may hold the version of key
+// visible as of seq and returns it, or nil if there is none
+func (r *SSTableReader) search(key string, seq uint64) (*item, error) {
+	target := seekKey(key, seq)
+	i := sort.Search(len(r.index), func(i int) bool {
+		return r.index[i].lastKey >= target
+	})
+	if i == len(r.index) {
+		return nil, nil
+	}
+	data, err := r.readDataBlock(r.index[i].handle)
+	if err != nil {
+		return nil, err
+	}
+	b, err := parseBlock(data)
+	if err != nil {
+		return nil, err
+	}
+	it, err := b.seek(target)
+	if err != nil || it == nil {
+		return nil, err
+	}
+	err = parseItem(it)
+	if err != nil || it.key != key {
+		return nil, err
+	}
+	return it, nil
+}
+
+// parseItem turns the internal key of an entry read from a
+// data block into its user key and sequence number
+func parseItem(it *item) error {
+	key, seq, kind, err := parseInternalKey(it.key)
+	if err != nil || kind != it.kind {
+		return ErrCorrupt
+	}
+	it.key, it.seq = key, seq
+	return nil
+}
+
+// FilterStats returns how the bloom filter has fared on lookups
+// made through this reader, or through every reader sharing its
+// counters
+func (r *SSTableReader) FilterStats() FilterStats {
+	return r.counters.stats()
+}
+
+func (r *SSTableReader) Has(key string) bool {
+	_, err := r.Get(key)
+	return err == nil
+}
+
+// Scan calls fn with the newest version of every key in the table
+// in key order until fn returns false. Keys whose newest version is
+// a tombstone, or that a newer range delete covers, are skipped.
+func (r *SSTableReader) Scan(fn func(key string, val []byte) bool) error {
+	it := newVisibleIterator(r.iter(), maxSequence, newRangeDelSet(r.dels, maxSequence))
+	for it.seek(""); it.valid(); it.next() {
+		if !fn(it.key(), it.value()) {
+			break
+		}
+	}
+	if err := it.err(); err != nil {
+		return fmt.Errorf("[SSTableReader.Scan] iterating: %v", err)
+	}
+	return nil
+}
+
+// readEntries reads and decodes the i-th data block
+func (r *SSTableReader) readEntries(i int) ([]item, error) {
+	data, err := r.readDataBlock(r.index[i].handle)
+	if err != nil {
+		return nil, err
+	}
+	b, err := parseBlock(data)
+	if err != nil {
+		return nil, err
+	}
+	ents, err := b.entries()
+	if err != nil {
+		return nil, err
+	}
+	for i := range ents {
+		err = parseItem(&ents[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ents, nil
+}
+
+// floor returns an item for the greatest key less than or equal
+// to key (or strictly less than key if strict is set), or nil if
+// there is no such key in the table. It is the oldest version held
+// of that key, whether visible or not.
+func (r *SSTableReader) floor(key string, strict bool) (*item, error) {
+	if r.table.count == 0 || key < r.table.smallest {
+		return nil, nil
+	}
+	target := seekKey(key, maxSequence)
+	i := sort.Search(len(r.index), func(i int) bool {
+		return r.index[i].lastKey >= target
+	})
+	if i == len(r.index) {
+		return r.last()
+	}
+	ents, err := r.readEntries(i)
+	if err != nil {
+		return nil, err
+	}
+	j := sort.Search(len(ents), func(j int) bool {
+		if strict {
+			return ents[j].key >= key
+		}
+		return ents[j].key > key
+	})
+	if j > 0 {
+		return r.ownedItem(&ents[j-1]), nil
+	}
+	if i == 0 {
+		return nil, nil
+	}
+	// no key in block i qualifies, so the floor
+	// is the last entry of the previous block
+	ents, err = r.readEntries(i - 1)
+	if err != nil || len(ents) == 0 {
+		return nil, err
+	}
+	return r.ownedItem(&ents[len(ents)-1]), nil
+}
+
+// last returns an item for the greatest key in the table, as floor does
+func (r *SSTableReader) last() (*item, error) {
+	if len(r.index) == 0 {
+		return nil, nil
+	}
+	ents, err := r.readEntries(len(r.index) - 1)
+	if err != nil || len(ents) == 0 {
+		return nil, err
+	}
+	return r.ownedItem(&ents[len(ents)-1]), nil
+}
+
+func (r *SSTableReader) iter() iterator {
+	return &tableIterator{r: r}
+}
+
+// NewIterator returns an Iterator over the table limited to the
+// keys opts allows, which must not be used once the reader has been
+// closed. Only the data blocks holding such keys are read.
+func (r *SSTableReader) NewIterator(opts *IterOptions) Iterator {
+	v := newVisibleIterator(r.iter(), maxSequence, newRangeDelSet(r.dels, maxSequence))
+	v.lower, v.upper = opts.bounds()
+	return &dbIterator{v: v}
+}
+
+// owned returns b, or a copy of it if b may refer to the mapped
+// file, so that it stays valid after the reader has been closed
+func (r *SSTableReader) owned(b []byte) []byte {
+	if r.data == nil || b == nil {
+		return b
+	}
+	return append(make([]byte, 0, len(b)), b...)
+}
+
+func (r *SSTableReader) ownedItem(it *item) *item {
+	if it != nil {
+		it.val = r.owned(it.val)
+	}
+	return it
+}
+
+// Close closes the table. The caller must make sure nothing is still
+// reading from it, since the file is unmapped if it was mapped.
+func (r *SSTableReader) Close() error {
+	for _, k := range r.pinned {
+		r.cache.unpin(k)
+	}
+	r.pinned = nil
+	r.filter = nil
+	if r.data != nil {
+		err := munmap(r.data)
+		r.data = nil
+		if err != nil {
+			r.file.Close()
+			return fmt.Errorf("[SSTableReader.Close] calling munmap: %v", err)
+		}
+	}
+	err := r.file.Close()
+	if err != nil {
+		return fmt.Errorf("[SSTableReader.Close] calling file.Close: %v", err)
+	}
+	return nil
+}
+
+func readBlockHandle(b []byte) (blockHandle, []byte, error) {
+	var h blockHandle
+	var n int
+	h.offset, n = binary.Uvarint(b)
+	if n <= 0 {
+		return h, nil, ErrCorrupt
+	}
+	b = b[n:]
+	h.size, n = binary.Uvarint(b)
+	if n <= 0 {
+		return h, nil, ErrCorrupt
+	}
+	return h, b[n:], nil
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func readString(b []byte) (string, []byte, error) {
+	p, b, err := readBytes(b)
+	return string(p), b, err
+}
+
+func readBytes(b []byte) ([]byte, []byte, error) {
+	n, i := binary.Uvarint(b)
+	if i <= 0 || uint64(len(b)-i) < n {
+		return nil, nil, ErrCorrupt
+	}
+	b = b[i:]
+	return b[:n:n], b[n:], nil
 }
@@ -0,0 +1,458 @@
+package lsm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/scottcagno/lsmt/pkg/lsm/rbtree"
+)
+
+func makeKey(i int) string {
+	return fmt.Sprintf("key-%.6d", i)
+}
+
+func makeVal(i int) []byte {
+	return []byte(fmt.Sprintf("{\"id\":%.6d,\"key\":\"key-%.6d\",\"value\":\"val-%.6d\"}", i, i, i))
+}
+
+func writeTestTable(t *testing.T, path string, n int) {
+	tree := rbtree.NewRBTree()
+	for i := 0; i < n; i++ {
+		tree.Put(makeKey(i), makeVal(i))
+	}
+	w, err := NewSSTableWriter(path, nil)
+	if err != nil {
+		t.Fatalf("new writer: %v", err)
+	}
+	tree.ScanFront(func(key string, value []byte) bool {
+		err = w.Write(key, value)
+		return err == nil
+	})
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("close writer: %v", err)
+	}
+}
+
+func TestSSTable_WriteAndGet(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "000001.sst")
+	writeTestTable(t, path, 1000)
+
+	r, err := OpenSSTableReader(path, nil)
+	if err != nil {
+		t.Fatalf("open reader: %v", err)
+	}
+	defer r.Close()
+
+	tbl := r.Table()
+	if tbl.Count() != 1000 {
+		t.Errorf("count: got %d, want %d", tbl.Count(), 1000)
+	}
+	if tbl.Smallest() != makeKey(0) || tbl.Largest() != makeKey(999) {
+		t.Errorf("bounds: got %q..%q", tbl.Smallest(), tbl.Largest())
+	}
+	if len(r.index) < 2 {
+		t.Errorf("expected multiple data blocks, got %d", len(r.index))
+	}
+	for i := 0; i < 1000; i++ {
+		val, err := r.Get(makeKey(i))
+		if err != nil {
+			t.Fatalf("get %q: %v", makeKey(i), err)
+		}
+		if !bytes.Equal(val, makeVal(i)) {
+			t.Fatalf("get %q: got %q, want %q", makeKey(i), val, makeVal(i))
+		}
+	}
+	for _, key := range []string{"", "a", "key-", "key-0000005", "key-001000", "zzz"} {
+		if r.Has(key) {
+			t.Errorf("has %q: expected miss", key)
+		}
+	}
+}
+
+func TestSSTable_Scan(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "000001.sst")
+	writeTestTable(t, path, 500)
+
+	r, err := OpenSSTableReader(path, nil)
+	if err != nil {
+		t.Fatalf("open reader: %v", err)
+	}
+	defer r.Close()
+
+	var i int
+	err = r.Scan(func(key string, val []byte) bool {
+		if key != makeKey(i) {
+			t.Errorf("scan: got %q, want %q", key, makeKey(i))
+		}
+		i++
+		return true
+	})
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if i != 500 {
+		t.Errorf("scan: got %d entries, want %d", i, 500)
+	}
+}
+
+func TestSSTable_KeyOrder(t *testing.T) {
+	w, err := NewSSTableWriter(filepath.Join(t.TempDir(), "000001.sst"), nil)
+	if err != nil {
+		t.Fatalf("new writer: %v", err)
+	}
+	if err = w.Write("b", nil); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err = w.Write("a", nil); err != ErrKeyOrder {
+		t.Errorf("write out of order: got %v, want %v", err, ErrKeyOrder)
+	}
+}
+
+func TestSSTable_Abort(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "000001.sst")
+	w, err := NewSSTableWriter(path, nil)
+	if err != nil {
+		t.Fatalf("new writer: %v", err)
+	}
+	if err = w.Write("a", nil); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	w.Abort()
+	for _, name := range []string{path, path + ".tmp"} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("%s: expected no file, got %v", name, err)
+		}
+	}
+}
+
+func TestSSTable_BadMagic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "000001.sst")
+	writeTestTable(t, path, 10)
+	fd, err := openOrCreate(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	_, err = fd.Write([]byte("garbage"))
+	fd.Close()
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	_, err = OpenSSTableReader(path, nil)
+	if err == nil {
+		t.Fatalf("expected error opening corrupt table")
+	}
+}
+
+func TestSSTable_BloomFilter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "000001.sst")
+	writeTestTable(t, path, 1000)
+	r, err := OpenSSTableReader(path, nil)
+	if err != nil {
+		t.Fatalf("open reader: %v", err)
+	}
+	defer r.Close()
+	if r.filter == nil {
+		t.Fatalf("expected the table to have a filter")
+	}
+	// no false negatives
+	for i := 0; i < 1000; i++ {
+		if !r.Has(makeKey(i)) {
+			t.Fatalf("has %q: expected hit", makeKey(i))
+		}
+	}
+	// keys that sort between the ones in the table get
+	// past the key range check and have to be filtered
+	for i := 0; i < 999; i++ {
+		if r.Has(makeKey(i) + "x") {
+			t.Fatalf("has %q: expected miss", makeKey(i)+"x")
+		}
+	}
+	stats := r.FilterStats()
+	if stats.Hits+stats.Misses != 1999 || stats.Hits-stats.FalsePositives != 1000 {
+		t.Fatalf("stats: got %+v", stats)
+	}
+	// 10 bits per key should give around one percent
+	if stats.FalsePositives > 30 {
+		t.Errorf("false positives: got %d in 1000", stats.FalsePositives)
+	}
+}
+
+func TestSSTable_OldVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "000001.sst")
+	writeTestTable(t, path, 10)
+	fd, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	fi, _ := fd.Stat()
+	var version [4]byte
+	binary.LittleEndian.PutUint32(version[:], sstableVersion-1)
+	_, err = fd.WriteAt(version[:], fi.Size()-sstableFooterLen+32)
+	fd.Close()
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	_, err = OpenSSTableReader(path, nil)
+	if !errors.Is(err, ErrBadVersion) {
+		t.Fatalf("open: got %v, want %v", err, ErrBadVersion)
+	}
+}
+
+func TestSSTable_FilterNewerVersions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "000001.sst")
+	w, err := NewSSTableWriter(path, nil)
+	if err != nil {
+		t.Fatalf("new writer: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		w.add(makeKey(i), uint64(i+10), typePut, makeVal(i))
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("close writer: %v", err)
+	}
+	r, err := OpenSSTableReader(path, nil)
+	if err != nil {
+		t.Fatalf("open reader: %v", err)
+	}
+	defer r.Close()
+
+	// a key that is only in the table as newer versions is
+	// invisible to the read, but the filter was still right
+	it, err := r.lookup(makeKey(50), 5)
+	if err != nil || it != nil {
+		t.Fatalf("lookup: got %v, %v", it, err)
+	}
+	if stats := r.FilterStats(); stats.Hits != 1 || stats.FalsePositives != 0 {
+		t.Fatalf("stats: got %+v", stats)
+	}
+}
+
+func TestSSTable_NoFilter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "000001.sst")
+	w, err := NewSSTableWriter(path, &TableOptions{BitsPerKey: -1})
+	if err != nil {
+		t.Fatalf("new writer: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		w.Write(makeKey(i), makeVal(i))
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("close writer: %v", err)
+	}
+	r, err := OpenSSTableReader(path, nil)
+	if err != nil {
+		t.Fatalf("open reader: %v", err)
+	}
+	defer r.Close()
+	if r.filter != nil {
+		t.Fatalf("expected no filter")
+	}
+	if !r.Has(makeKey(50)) || r.Has(makeKey(50)+"x") {
+		t.Fatalf("lookups without a filter failed")
+	}
+	if stats := r.FilterStats(); stats != (FilterStats{}) {
+		t.Fatalf("stats: got %+v", stats)
+	}
+}
+
+func TestSSTable_PrefixCompression(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, opts *TableOptions) *SSTableReader {
+		path := filepath.Join(dir, name)
+		w, err := NewSSTableWriter(path, opts)
+		if err != nil {
+			t.Fatalf("new writer: %v", err)
+		}
+		for i := 0; i < 1000; i++ {
+			w.Write(fmt.Sprintf("tenant/user/%06d", i), []byte("v"))
+		}
+		if err = w.Close(); err != nil {
+			t.Fatalf("close writer: %v", err)
+		}
+		r, err := OpenSSTableReader(path, nil)
+		if err != nil {
+			t.Fatalf("open reader: %v", err)
+		}
+		return r
+	}
+	// a restart point on every key stores every key in full
+	full := write("full.sst", &TableOptions{BlockSize: 512, RestartInterval: 1})
+	defer full.Close()
+	r := write("prefix.sst", &TableOptions{BlockSize: 512, RestartInterval: 4})
+	defer r.Close()
+	if r.table.size >= full.table.size*3/4 {
+		t.Errorf("size: got %d bytes, %d without shared prefixes", r.table.size, full.table.size)
+	}
+	if len(r.index) < 4 {
+		t.Errorf("expected several blocks, got %d", len(r.index))
+	}
+	for i := 0; i < 1000; i++ {
+		k := fmt.Sprintf("tenant/user/%06d", i)
+		if v, err := r.Get(k); err != nil || string(v) != "v" {
+			t.Fatalf("get %q: got %q (%v)", k, v, err)
+		}
+		if r.Has(k + "x") {
+			t.Fatalf("has %q: expected miss", k+"x")
+		}
+		it, err := r.floor(k+"x", false)
+		if err != nil || it == nil || it.key != k {
+			t.Fatalf("floor %q: got %v (%v)", k+"x", it, err)
+		}
+	}
+	var n int
+	it := r.iter()
+	for it.seek("tenant/user/000500"); it.valid(); it.next() {
+		if want := fmt.Sprintf("tenant/user/%06d", 500+n); it.key() != want {
+			t.Fatalf("iter: got %q, want %q", it.key(), want)
+		}
+		n++
+	}
+	if n != 500 || it.err() != nil {
+		t.Fatalf("iter: got %d entries (%v)", n, it.err())
+	}
+}
+
+// blockCodec returns the codec id in the trailer of data block i
+func blockCodec(t *testing.T, r *SSTableReader, i int) byte {
+	data, err := r.readBlock(r.index[i].handle)
+	if err != nil {
+		t.Fatalf("read block: %v", err)
+	}
+	return data[len(data)-blockTrailerLen]
+}
+
+func TestSSTable_Compression(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, c Compressor, val func(i int) []byte) *SSTableReader {
+		path := filepath.Join(dir, name)
+		w, err := NewSSTableWriter(path, &TableOptions{Compressor: c})
+		if err != nil {
+			t.Fatalf("new writer: %v", err)
+		}
+		for i := 0; i < 1000; i++ {
+			w.Write(makeKey(i), val(i))
+		}
+		if err = w.Close(); err != nil {
+			t.Fatalf("close writer: %v", err)
+		}
+		r, err := OpenSSTableReader(path, nil)
+		if err != nil {
+			t.Fatalf("open reader: %v", err)
+		}
+		return r
+	}
+	raw := write("raw.sst", nil, makeVal)
+	defer raw.Close()
+	r := write("flate.sst", &FlateCompressor{Level: 6}, makeVal)
+	defer r.Close()
+	if r.table.size >= raw.table.size/2 {
+		t.Errorf("size: got %d bytes compressed, %d raw", r.table.size, raw.table.size)
+	}
+	if id := blockCodec(t, r, 0); id != FlateID {
+		t.Errorf("codec: got %d, want %d", id, FlateID)
+	}
+	for i := 0; i < 1000; i++ {
+		if v, err := r.Get(makeKey(i)); err != nil || !bytes.Equal(v, makeVal(i)) {
+			t.Fatalf("get %q: got %q (%v)", makeKey(i), v, err)
+		}
+	}
+
+	// blocks that do not compress are stored as they are
+	rnd := rand.New(rand.NewSource(1))
+	noise := write("noise.sst", &FlateCompressor{Level: 6}, func(int) []byte {
+		b := make([]byte, 256)
+		rnd.Read(b)
+		return b
+	})
+	defer noise.Close()
+	if id := blockCodec(t, noise, 0); id != NoCompressionID {
+		t.Errorf("codec: got %d, want %d", id, NoCompressionID)
+	}
+
+	// a damaged block fails its checksum
+	fd, err := os.OpenFile(r.table.path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	fd.WriteAt([]byte{0xff, 0xff}, 10)
+	fd.Close()
+	if _, err = r.Get(makeKey(0)); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("get from damaged block: got %v, want %v", err, ErrCorrupt)
+	}
+}
+
+func TestSSTable_Mmap(t *testing.T) {
+	dir := t.TempDir()
+	raw := filepath.Join(dir, "raw.sst")
+	writeTestTable(t, raw, 1000)
+	compressed := filepath.Join(dir, "flate.sst")
+	w, err := NewSSTableWriter(compressed, &TableOptions{Compressor: &FlateCompressor{Level: 6}})
+	if err != nil {
+		t.Fatalf("new writer: %v", err)
+	}
+	for i := 0; i < 1000; i++ {
+		w.Write(makeKey(i), makeVal(i))
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("close writer: %v", err)
+	}
+
+	cache := NewBlockCache(1 << 20)
+	for n, path := range []string{raw, compressed} {
+		r, err := OpenSSTableReader(path, &ReaderOptions{Cache: cache, FileNum: uint64(n), Mmap: true})
+		if err != nil {
+			t.Fatalf("open reader: %v", err)
+		}
+		if r.data == nil {
+			r.Close()
+			t.Skip("mmap is not supported here")
+		}
+		vals := make([][]byte, 0, 1000)
+		for i := 0; i < 1000; i++ {
+			v, err := r.Get(makeKey(i))
+			if err != nil || !bytes.Equal(v, makeVal(i)) {
+				t.Fatalf("get %q: got %q (%v)", makeKey(i), v, err)
+			}
+			vals = append(vals, v)
+		}
+		var i int
+		err = r.Scan(func(key string, val []byte) bool {
+			vals = append(vals, val)
+			i++
+			return true
+		})
+		if err != nil || i != 1000 {
+			t.Fatalf("scan: got %d entries (%v)", i, err)
+		}
+		if err = r.Close(); err != nil {
+			t.Fatalf("close reader: %v", err)
+		}
+		// nothing handed out refers to the unmapped file
+		for i, v := range vals {
+			if !bytes.Equal(v, makeVal(i%1000)) {
+				t.Fatalf("value %d after close: got %q", i, v)
+			}
+		}
+	}
+	// blocks read in place are never cached, decompressed ones are
+	stats := cache.Stats()
+	if stats.Size == 0 || stats.Size > 96<<10 {
+		t.Errorf("cache size: got %d", stats.Size)
+	}
+	if _, ok := cache.get(cacheKey{file: 0, offset: 0}); ok {
+		t.Errorf("expected the mapped raw blocks not to be cached")
+	}
+	if _, ok := cache.get(cacheKey{file: 1, offset: 0}); !ok {
+		t.Errorf("expected the decompressed blocks to be cached")
+	}
+}
@@ -0,0 +1,160 @@
+package lsm
+
+import (
+	"sync"
+	"time"
+)
+
+// StallState describes how much writes are being held back
+// to let flushing and compaction catch up
+type StallState int
+
+const (
+	StallNone     StallState = iota // writes go ahead
+	StallSlowdown                   // every write is delayed
+	StallStopped                    // writes wait until things improve
+)
+
+func (s StallState) String() string {
+	switch s {
+	case StallNone:
+		return "none"
+	case StallSlowdown:
+		return "slowdown"
+	case StallStopped:
+		return "stopped"
+	}
+	return "unknown"
+}
+
+// StallReason is the trigger behind a write stall
+type StallReason int
+
+const (
+	StallNoReason          StallReason = iota
+	StallMemtables                     // too many sealed memtables waiting to be flushed
+	StallL0Tables                      // too many tables in level 0
+	StallPendingCompaction             // too many bytes waiting to be compacted
+)
+
+func (r StallReason) String() string {
+	switch r {
+	case StallNoReason:
+		return "none"
+	case StallMemtables:
+		return "memtables"
+	case StallL0Tables:
+		return "level 0 tables"
+	case StallPendingCompaction:
+		return "pending compaction"
+	}
+	return "unknown"
+}
+
+// StallInfo describes a change of stall state, as
+// passed to the OnWriteStall callback
+type StallInfo struct {
+	Prev   StallState
+	State  StallState
+	Reason StallReason // trigger behind State
+}
+
+// StallStats describes the write stalls of a tree since it was opened
+type StallStats struct {
+	State     StallState
+	Reason    StallReason
+	Slowdowns int64         // writes that were delayed
+	Stops     int64         // writes that had to wait for writes to resume
+	Stalled   time.Duration // total time writes were held back
+}
+
+// stallInputs is what the stall state is worked out from
+type stallInputs struct {
+	sealed  int   // sealed memtables
+	l0      int   // tables in level 0
+	pending int64 // bytes of tables waiting to be compacted
+}
+
+// stallState works out the stall state for in, stops taking
+// precedence over slowdowns. Negative triggers are never reached.
+func (o *Options) stallState(in stallInputs) (StallState, StallReason) {
+	reached := func(n, trigger int64) bool {
+		return trigger >= 0 && n >= trigger
+	}
+	switch {
+	case reached(int64(in.sealed), int64(o.MemtableStopTrigger)):
+		return StallStopped, StallMemtables
+	case reached(int64(in.l0), int64(o.L0StopTrigger)):
+		return StallStopped, StallL0Tables
+	case reached(in.pending, o.PendingCompactionStopBytes):
+		return StallStopped, StallPendingCompaction
+	case reached(int64(in.sealed), int64(o.MemtableSlowdownTrigger)):
+		return StallSlowdown, StallMemtables
+	case reached(int64(in.l0), int64(o.L0SlowdownTrigger)):
+		return StallSlowdown, StallL0Tables
+	case reached(in.pending, o.PendingCompactionSlowdownBytes):
+		return StallSlowdown, StallPendingCompaction
+	}
+	return StallNone, StallNoReason
+}
+
+// writeController holds back writes while the tree is stalled
+type writeController struct {
+	mu      sync.Mutex
+	cond    sync.Cond
+	delay   time.Duration // slowdown per write
+	onStall func(StallInfo)
+	err     error // background error, fails stopped writes
+	stats   StallStats
+}
+
+func newWriteController(delay time.Duration, onStall func(StallInfo)) *writeController {
+	c := &writeController{delay: delay, onStall: onStall}
+	c.cond.L = &c.mu
+	return c
+}
+
+// set changes the stall state, waking any stopped writers
+// and reporting the change to the callback if there is one
+func (c *writeController) set(state StallState, reason StallReason, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		c.err = err
+	}
+	prev := c.stats.State
+	c.stats.State, c.stats.Reason = state, reason
+	c.cond.Broadcast()
+	if state != prev && c.onStall != nil {
+		c.onStall(StallInfo{Prev: prev, State: state, Reason: reason})
+	}
+}
+
+// wait holds back a write for as long as the stall state calls for,
+// and returns the background error if there is one
+func (c *writeController) wait() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stats.State == StallStopped && c.err == nil {
+		c.stats.Stops++
+		start := time.Now()
+		for c.stats.State == StallStopped && c.err == nil {
+			c.cond.Wait()
+		}
+		c.stats.Stalled += time.Since(start)
+	}
+	if c.stats.State == StallSlowdown && c.err == nil {
+		c.stats.Slowdowns++
+		c.stats.Stalled += c.delay
+		c.mu.Unlock()
+		time.Sleep(c.delay)
+		c.mu.Lock()
+	}
+	return c.err
+}
+
+func (c *writeController) statsSnapshot() StallStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
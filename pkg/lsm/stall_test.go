@@ -0,0 +1,109 @@
+package lsm
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStallState(t *testing.T) {
+	opts := DefaultOptions
+	opts.L0SlowdownTrigger = -1
+	for _, tc := range []struct {
+		in     stallInputs
+		state  StallState
+		reason StallReason
+	}{
+		{stallInputs{}, StallNone, StallNoReason},
+		{stallInputs{sealed: 3}, StallSlowdown, StallMemtables},
+		{stallInputs{sealed: 4}, StallStopped, StallMemtables},
+		{stallInputs{l0: 30}, StallNone, StallNoReason},
+		{stallInputs{l0: 36}, StallStopped, StallL0Tables},
+		{stallInputs{sealed: 3, l0: 36}, StallStopped, StallL0Tables},
+		{stallInputs{pending: 300 << 20}, StallSlowdown, StallPendingCompaction},
+		{stallInputs{pending: 2 << 30}, StallStopped, StallPendingCompaction},
+	} {
+		state, reason := opts.stallState(tc.in)
+		if state != tc.state || reason != tc.reason {
+			t.Errorf("%+v: got %v (%v), want %v (%v)", tc.in, state, reason, tc.state, tc.reason)
+		}
+	}
+}
+
+func TestLSMTree_WriteStall(t *testing.T) {
+	var mu sync.Mutex
+	var events []StallInfo
+	db, err := Open(t.TempDir(), &Options{
+		MemtableSize:            16 << 10,
+		MemtableSlowdownTrigger: 1,
+		MemtableStopTrigger:     2,
+		OnWriteStall: func(info StallInfo) {
+			mu.Lock()
+			events = append(events, info)
+			mu.Unlock()
+		},
+	})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer db.Close()
+
+	// with the background flusher held up, writes slow down once a
+	// memtable is sealed and stop once a second one is
+	db.bgMu.Lock()
+	done := make(chan int)
+	go func() {
+		i := 0
+		for ; i < 1000; i++ {
+			if err := db.Put(makeKey(i), makeVal(i)); err != nil {
+				t.Errorf("put: %v", err)
+				break
+			}
+		}
+		done <- i
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for db.StallStats().State != StallStopped {
+		if time.Now().After(deadline) {
+			db.bgMu.Unlock()
+			t.Fatalf("expected writes to stop, got %+v", db.StallStats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case i := <-done:
+		db.bgMu.Unlock()
+		t.Fatalf("writes carried on while stopped, %d done", i)
+	case <-time.After(50 * time.Millisecond):
+	}
+	db.bgMu.Unlock()
+
+	// the writes resume once the flusher catches up
+	if i := <-done; i != 1000 {
+		t.Fatalf("puts: got %d, want %d", i, 1000)
+	}
+	if err = db.Flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	stats := db.StallStats()
+	if stats.State != StallNone || stats.Slowdowns == 0 || stats.Stops == 0 || stats.Stalled == 0 {
+		t.Fatalf("stats: got %+v", stats)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) < 3 {
+		t.Fatalf("events: got %v", events)
+	}
+	want := []StallInfo{
+		{Prev: StallNone, State: StallSlowdown, Reason: StallMemtables},
+		{Prev: StallSlowdown, State: StallStopped, Reason: StallMemtables},
+	}
+	for i, ev := range want {
+		if events[i] != ev {
+			t.Errorf("event %d: got %+v, want %+v", i, events[i], ev)
+		}
+	}
+	if last := events[len(events)-1]; last.State != StallNone {
+		t.Errorf("last event: got %+v", last)
+	}
+}
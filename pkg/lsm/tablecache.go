@@ -0,0 +1,217 @@
+package lsm
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// defaultMaxOpenFiles is the number of sstables a tree keeps open
+const defaultMaxOpenFiles = 1000
+
+// tableCache opens the sstables of a tree on demand and keeps up to
+// capacity of them open, closing the least recently used ones once
+// there are more. A table is acquired before it is read and released
+// afterwards, and is never closed while acquired, so the limit can be
+// exceeded while more tables than that are in use at once.
+//
+// Tables that compaction has replaced are removed through the cache,
+// which deletes the file once the last reader holding it lets go.
+type tableCache struct {
+	mu       sync.Mutex
+	dir      string
+	capacity int
+	opts     ReaderOptions   // options every table is opened with
+	counters *filterCounters // filter stats shared by every table
+	tables   map[uint64]*tableHandle
+	lru      list.List // open tables no one holds, most recently used first
+}
+
+type tableHandle struct {
+	num      uint64
+	r        *SSTableReader
+	err      error         // why the table could not be opened
+	loaded   chan struct{} // closed once r or err is set
+	refs     int
+	elem     *list.Element // position in the LRU list, nil while held
+	obsolete bool          // delete the file once released
+}
+
+func newTableCache(dir string, capacity int, opts ReaderOptions, counters *filterCounters) *tableCache {
+	return &tableCache{
+		dir:      dir,
+		capacity: capacity,
+		opts:     opts,
+		counters: counters,
+		tables:   make(map[uint64]*tableHandle),
+	}
+}
+
+func (c *tableCache) path(num uint64) string {
+	return filepath.Join(c.dir, fmt.Sprintf("%06d%s", num, sstableExt))
+}
+
+// acquire returns a reader for table num, opening it if it is not
+// open already. The reader stays open until it is released. The file
+// is opened without holding the lock, anyone else after the same
+// table waits for it to be opened while the rest carry on.
+func (c *tableCache) acquire(num uint64) (*SSTableReader, error) {
+	c.mu.Lock()
+	h, ok := c.tables[num]
+	if !ok {
+		h = &tableHandle{num: num, loaded: make(chan struct{})}
+		c.tables[num] = h
+	}
+	if h.elem != nil {
+		c.lru.Remove(h.elem)
+		h.elem = nil
+	}
+	h.refs++
+	c.mu.Unlock()
+	if !ok {
+		c.load(h)
+	}
+	<-h.loaded
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if h.err != nil {
+		// forget the table, so that the next acquire tries again
+		h.refs--
+		if c.tables[num] == h {
+			delete(c.tables, num)
+		}
+		if h.refs == 0 && h.obsolete {
+			removeFile(c.path(num))
+		}
+		return nil, h.err
+	}
+	c.evict()
+	return h.r, nil
+}
+
+// load opens the table of h, which is held by the caller
+func (c *tableCache) load(h *tableHandle) {
+	opts := c.opts
+	opts.FileNum = h.num
+	h.r, h.err = OpenSSTableReader(c.path(h.num), &opts)
+	if h.err == nil {
+		h.r.counters = c.counters
+	}
+	close(h.loaded)
+}
+
+// release gives back a reader returned by acquire
+func (c *tableCache) release(num uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h, ok := c.tables[num]
+	if !ok || h.refs == 0 {
+		return nil
+	}
+	h.refs--
+	if h.refs > 0 {
+		return nil
+	}
+	if h.obsolete {
+		return c.drop(h)
+	}
+	h.elem = c.lru.PushFront(h)
+	c.evict()
+	return nil
+}
+
+// remove deletes table num, which must no longer be live, as
+// soon as no one holds it
+func (c *tableCache) remove(num uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h, ok := c.tables[num]
+	if !ok {
+		return removeFile(c.path(num))
+	}
+	h.obsolete = true
+	if h.refs > 0 {
+		return nil
+	}
+	if h.elem != nil {
+		c.lru.Remove(h.elem)
+		h.elem = nil
+	}
+	return c.drop(h)
+}
+
+// drop closes an obsolete table and deletes its file. The
+// caller must hold the lock.
+func (c *tableCache) drop(h *tableHandle) error {
+	delete(c.tables, h.num)
+	err := h.r.Close()
+	if rerr := removeFile(c.path(h.num)); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// evict closes tables no one holds, least recently used first,
+// until no more than capacity are open. The caller must hold the lock.
+func (c *tableCache) evict() {
+	for len(c.tables) > c.capacity {
+		back := c.lru.Back()
+		if back == nil {
+			return
+		}
+		h := back.Value.(*tableHandle)
+		c.lru.Remove(back)
+		delete(c.tables, h.num)
+		h.r.Close()
+	}
+}
+
+// open returns the number of tables currently open
+func (c *tableCache) open() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.tables)
+}
+
+// close closes every open table, whether held or not, and deletes
+// the files of the obsolete ones
+func (c *tableCache) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var err error
+	for _, h := range c.tables {
+		select {
+		case <-h.loaded:
+		default:
+			// still being opened, by someone who is not done with it
+			continue
+		}
+		if h.err != nil {
+			continue
+		}
+		cerr := h.r.Close()
+		if h.obsolete {
+			if rerr := removeFile(c.path(h.num)); cerr == nil {
+				cerr = rerr
+			}
+		}
+		if cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	c.tables = make(map[uint64]*tableHandle)
+	c.lru.Init()
+	return err
+}
+
+// removeFile removes the file at path if it exists
+func removeFile(path string) error {
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package lsm
+
+import (
+	"os"
+	"sync"
+	"testing"
+)
+
+// tableReader acquires table num of db for the rest of the test
+func tableReader(t *testing.T, db *LSMTree, num uint64) *SSTableReader {
+	r, err := db.tables.acquire(num)
+	if err != nil {
+		t.Fatalf("acquire table %d: %v", num, err)
+	}
+	t.Cleanup(func() { db.tables.release(num) })
+	return r
+}
+
+func TestTableCache_MaxOpenFiles(t *testing.T) {
+	dir := t.TempDir()
+	opts := &Options{
+		MaxOpenFiles:        4,
+		L0CompactionTrigger: 100,
+		Compaction:          &LeveledCompaction{L0Trigger: 100},
+	}
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	for i := 0; i < 200; i++ {
+		db.Put(makeKey(i), makeVal(i))
+		if i%20 == 19 {
+			db.Flush()
+		}
+	}
+	if n := len(db.live); n != 10 {
+		t.Fatalf("tables: got %d, want %d", n, 10)
+	}
+	check := func() {
+		for i := 0; i < 200; i++ {
+			if _, err := db.Get(makeKey(i)); err != nil {
+				t.Fatalf("get %q: %v", makeKey(i), err)
+			}
+			if n := db.tables.open(); n > 4 {
+				t.Fatalf("open tables: got %d, want at most %d", n, 4)
+			}
+		}
+	}
+	check()
+	// iterating needs every table at once, and the extra
+	// ones are closed again as soon as it is done
+	if n, err := db.Count(); err != nil || n != 200 {
+		t.Fatalf("count: got %d (%v), want %d", n, err, 200)
+	}
+	if n := db.tables.open(); n > 4 {
+		t.Fatalf("open tables after count: got %d, want at most %d", n, 4)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	// tables are only opened once they are read
+	db, err = Open(dir, opts)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer db.Close()
+	if n := db.tables.open(); n != 0 {
+		t.Fatalf("open tables after reopen: got %d, want 0", n)
+	}
+	check()
+}
+
+func TestTableCache_DeferredDelete(t *testing.T) {
+	db := openTestTree(t, t.TempDir())
+	defer db.Close()
+	for i := 0; i < 100; i++ {
+		db.Put(makeKey(i), makeVal(i))
+		if i%50 == 49 {
+			db.Flush()
+		}
+	}
+	old := db.live[0].num
+	path := db.tablePath(old)
+	// hold on to a table the way an open iterator would
+	r, err := db.tables.acquire(old)
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	it := r.iter()
+	it.seek("")
+	if err = db.Compact(); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	for _, meta := range db.live {
+		if meta.num == old {
+			t.Fatalf("expected table %d to have been compacted away", old)
+		}
+	}
+	if _, err = os.Stat(path); err != nil {
+		t.Fatalf("expected %s to outlive the compaction: %v", path, err)
+	}
+	var n int
+	for ; it.valid(); it.next() {
+		n++
+	}
+	if n != 50 || it.err() != nil {
+		t.Fatalf("iter: got %d entries (%v), want %d", n, it.err(), 50)
+	}
+	if err = db.tables.release(old); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to be deleted once released, got %v", path, err)
+	}
+}
+
+func TestTableCache_ConcurrentAcquire(t *testing.T) {
+	c := newTableCache(t.TempDir(), 2, ReaderOptions{}, new(filterCounters))
+	defer c.close()
+	const tables = 4
+	for num := uint64(1); num <= tables; num++ {
+		writeTestTable(t, c.path(num), 50)
+	}
+	// everyone after the same table gets the one reader
+	readers := make([]*SSTableReader, 16)
+	var wg sync.WaitGroup
+	for i := range readers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r, err := c.acquire(uint64(i%tables + 1))
+			if err != nil {
+				t.Errorf("acquire: %v", err)
+			}
+			readers[i] = r
+		}(i)
+	}
+	wg.Wait()
+	for i, r := range readers {
+		if r != readers[i%tables] {
+			t.Fatalf("acquire %d: got a second reader for table %d", i, i%tables+1)
+		}
+		c.release(uint64(i%tables + 1))
+	}
+	if n := c.open(); n != 2 {
+		t.Fatalf("open tables: got %d, want %d", n, 2)
+	}
+
+	// a table that fails to open is not kept
+	for i := 0; i < 2; i++ {
+		if _, err := c.acquire(999); err == nil {
+			t.Fatalf("acquire missing table: expected an error")
+		}
+	}
+	if n := c.open(); n != 2 {
+		t.Fatalf("open tables: got %d, want %d", n, 2)
+	}
+}
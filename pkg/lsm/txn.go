@@ -0,0 +1,273 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var (
+	ErrConflict = errors.New("txn: conflicting write")
+	ErrTxnDone  = errors.New("txn: already committed or rolled back")
+)
+
+// Txn is a transaction, optimistic unless begun with BeginPessimisticTxn.
+// It reads from a snapshot taken when it began, overlaid with its own
+// writes, which are held back until Commit writes them all at once as
+// a single batch. An optimistic Commit fails with ErrConflict if any
+// key the transaction read has been written to since it began, in
+// which case nothing is written and the transaction can be retried
+// from the start.
+//
+// Only keys that were actually read are checked, so a key that did
+// not exist and was not asked for, but would have turned up in an
+// iteration, does not cause a conflict. Commits of transactions are
+// checked against one another exactly, a plain write that lands while
+// a transaction is committing may not be. A Txn is not safe for
+// concurrent use.
+//
+// A pessimistic transaction, see BeginPessimisticTxn, locks keys
+// instead of checking them at commit.
+type Txn struct {
+	t      *LSMTree
+	snap   *Snapshot
+	writes map[string]*item    // pending writes, newest for each key
+	reads  map[string]struct{} // keys read from the snapshot
+	done   bool
+	id     uint64   // lock owner id, zero if optimistic
+	locked []string // keys locked, if pessimistic
+}
+
+// BeginTxn starts a transaction. It must be finished with
+// Commit or Rollback, or it holds on to its snapshot.
+func (t *LSMTree) BeginTxn() *Txn {
+	return &Txn{
+		t:      t,
+		snap:   t.NewSnapshot(),
+		writes: make(map[string]*item),
+		reads:  make(map[string]struct{}),
+	}
+}
+
+// BeginPessimisticTxn starts a pessimistic transaction, which takes
+// an exclusive lock on every key it writes or reads with GetForUpdate,
+// held until it commits or rolls back. Waiting for a key locked by
+// another gives up with ErrLockTimeout after Options.LockTimeout, or
+// with ErrDeadlock straight away if the other is itself waiting on
+// this transaction, in either case the transaction should be rolled
+// back. Its commits never conflict: keys read with GetForUpdate cannot
+// change under it, and those read with Get are not checked. The locks
+// are only taken by pessimistic transactions, plain writes and
+// optimistic transactions do not wait for them.
+func (t *LSMTree) BeginPessimisticTxn() *Txn {
+	x := t.BeginTxn()
+	x.id = t.locks.newID()
+	return x
+}
+
+// lock takes the lock on k if the transaction is pessimistic
+func (x *Txn) lock(k string) error {
+	if x.id == 0 {
+		return nil
+	}
+	taken, err := x.t.locks.acquire(x.id, k, x.t.opts.LockTimeout)
+	if err != nil {
+		return err
+	}
+	if taken {
+		x.locked = append(x.locked, k)
+	}
+	return nil
+}
+
+func (x *Txn) Get(k string) ([]byte, error) {
+	if x.done {
+		return nil, ErrTxnDone
+	}
+	if it, ok := x.writes[k]; ok {
+		if it.kind == typeDel {
+			return nil, ErrNotFound
+		}
+		return it.val, nil
+	}
+	x.reads[k] = struct{}{}
+	return x.snap.Get(k)
+}
+
+// GetForUpdate locks k and returns its newest value, which no one
+// else can change until the transaction is done. In an optimistic
+// transaction it is the same as Get.
+func (x *Txn) GetForUpdate(k string) ([]byte, error) {
+	if x.done {
+		return nil, ErrTxnDone
+	}
+	if x.id == 0 {
+		return x.Get(k)
+	}
+	err := x.lock(k)
+	if err != nil {
+		return nil, err
+	}
+	if it, ok := x.writes[k]; ok {
+		if it.kind == typeDel {
+			return nil, ErrNotFound
+		}
+		return it.val, nil
+	}
+	return x.t.Get(k)
+}
+
+func (x *Txn) Has(k string) bool {
+	_, err := x.Get(k)
+	return err == nil
+}
+
+func (x *Txn) Put(k string, v []byte) error {
+	if x.done {
+		return ErrTxnDone
+	}
+	err := x.lock(k)
+	if err != nil {
+		return err
+	}
+	x.writes[k] = &item{key: k, kind: typePut, val: append([]byte(nil), v...)}
+	return nil
+}
+
+func (x *Txn) Del(k string) error {
+	if x.done {
+		return ErrTxnDone
+	}
+	err := x.lock(k)
+	if err != nil {
+		return err
+	}
+	x.writes[k] = &item{key: k, kind: typeDel}
+	return nil
+}
+
+// Iter calls fn for every entry the transaction can see in key order
+// until fn returns false. Every key passed to fn that is not one of
+// the transaction's own writes counts as read. The tree is read locked
+// for the duration of the call, so fn must not write to the tree.
+func (x *Txn) Iter(fn func(k string, v []byte) bool) error {
+	if x.done {
+		return ErrTxnDone
+	}
+	pending := x.pending()
+	x.t.mu.RLock()
+	defer x.t.mu.RUnlock()
+	it, release, err := x.t.iter(x.snap.seq, "", "")
+	defer release()
+	if err != nil {
+		return fmt.Errorf("[Txn.Iter] calling iter: %v", err)
+	}
+	it.seek("")
+	for it.valid() || len(pending) > 0 {
+		var k string
+		var v []byte
+		switch {
+		case len(pending) > 0 && (!it.valid() || pending[0].key <= it.key()):
+			w := pending[0]
+			pending = pending[1:]
+			if it.valid() && it.key() == w.key {
+				it.next()
+			}
+			if w.kind == typeDel {
+				continue
+			}
+			k, v = w.key, w.val
+		default:
+			k, v = it.key(), it.value()
+			x.reads[k] = struct{}{}
+			it.next()
+		}
+		if !fn(k, v) {
+			return nil
+		}
+	}
+	return it.err()
+}
+
+// pending returns the pending writes in key order
+func (x *Txn) pending() []*item {
+	its := make([]*item, 0, len(x.writes))
+	for _, it := range x.writes {
+		its = append(its, it)
+	}
+	sort.Slice(its, func(i, j int) bool { return its[i].key < its[j].key })
+	return its
+}
+
+// Commit writes the transaction's writes to the tree atomically,
+// unless a key it read has been written to since it began, in which
+// case it returns ErrConflict. Either way the transaction is done
+// and any locks it holds are released.
+func (x *Txn) Commit() error {
+	if x.done {
+		return ErrTxnDone
+	}
+	defer x.Rollback()
+	if len(x.writes) == 0 {
+		// everything read came from one snapshot
+		return nil
+	}
+	var b WriteBatch
+	for _, it := range x.pending() {
+		if it.kind == typeDel {
+			b.Del(it.key)
+		} else {
+			b.Put(it.key, it.val)
+		}
+	}
+	x.t.txnMu.Lock()
+	defer x.t.txnMu.Unlock()
+	if x.id != 0 {
+		// the keys are locked, but an optimistic commit still
+		// has to see this write before it checks its reads
+		err := x.t.Write(&b)
+		if err != nil {
+			return fmt.Errorf("[Txn.Commit] calling Write: %v", err)
+		}
+		return nil
+	}
+	for k := range x.reads {
+		seq, err := x.t.lastWrite(k)
+		if err != nil {
+			return fmt.Errorf("[Txn.Commit] calling lastWrite: %v", err)
+		}
+		if seq > x.snap.seq {
+			return ErrConflict
+		}
+	}
+	err := x.t.Write(&b)
+	if err != nil {
+		return fmt.Errorf("[Txn.Commit] calling Write: %v", err)
+	}
+	return nil
+}
+
+// Rollback throws away the transaction's writes and releases any
+// locks it holds. Calling it more than once, or after Commit, is fine.
+func (x *Txn) Rollback() {
+	if !x.done {
+		x.done = true
+		x.snap.Release()
+		if x.id != 0 {
+			x.t.locks.release(x.id, x.locked)
+			x.locked = nil
+		}
+	}
+}
+
+// lastWrite returns the sequence number of the newest write to k,
+// counting deletes and range deletes, or zero if there is none
+func (t *LSMTree) lastWrite(k string) (uint64, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	it, err := t.lookup(k, maxSequence)
+	if err != nil || it == nil {
+		return 0, err
+	}
+	return it.seq, nil
+}
@@ -0,0 +1,249 @@
+package lsm
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTxn_ReadYourWrites(t *testing.T) {
+	db := openTestTree(t, t.TempDir())
+	defer db.Close()
+	for i := 0; i < 10; i++ {
+		db.Put(makeKey(i), makeVal(i))
+	}
+	x := db.BeginTxn()
+	x.Put(makeKey(3), []byte("mine"))
+	x.Del(makeKey(5))
+	x.Put(makeKey(20), []byte("new"))
+	// the tree moves on behind its back
+	db.Put(makeKey(7), []byte("theirs"))
+
+	if v, err := x.Get(makeKey(3)); err != nil || string(v) != "mine" {
+		t.Fatalf("get %q: got %q (%v)", makeKey(3), v, err)
+	}
+	if x.Has(makeKey(5)) {
+		t.Fatalf("has %q: expected deleted", makeKey(5))
+	}
+	if v, err := x.Get(makeKey(7)); err != nil || !bytes.Equal(v, makeVal(7)) {
+		t.Fatalf("get %q: got %q (%v)", makeKey(7), v, err)
+	}
+	var got []string
+	err := x.Iter(func(k string, v []byte) bool {
+		got = append(got, k+"="+string(v))
+		return true
+	})
+	if err != nil {
+		t.Fatalf("iter: %v", err)
+	}
+	var want []string
+	for i := 0; i < 10; i++ {
+		switch i {
+		case 3:
+			want = append(want, makeKey(i)+"=mine")
+		case 5:
+		default:
+			want = append(want, makeKey(i)+"="+string(makeVal(i)))
+		}
+	}
+	want = append(want, makeKey(20)+"=new")
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("iter: got %q, want %q", got, want)
+	}
+	// nothing is written until commit
+	if v, err := db.Get(makeKey(3)); err != nil || !bytes.Equal(v, makeVal(3)) {
+		t.Fatalf("tree get %q: got %q (%v)", makeKey(3), v, err)
+	}
+
+	// having iterated, it read the key written behind its back
+	if err := x.Commit(); err != ErrConflict {
+		t.Fatalf("commit: got %v, want %v", err, ErrConflict)
+	}
+	if db.Has(makeKey(20)) {
+		t.Fatalf("expected nothing written by a conflicting commit")
+	}
+	if err := x.Put("a", nil); err != ErrTxnDone {
+		t.Fatalf("put after commit: got %v, want %v", err, ErrTxnDone)
+	}
+
+	x = db.BeginTxn()
+	x.Get(makeKey(3))
+	x.Put(makeKey(3), []byte("mine"))
+	x.Del(makeKey(5))
+	db.Put(makeKey(7), []byte("unread"))
+	if err := x.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if v, err := db.Get(makeKey(3)); err != nil || string(v) != "mine" {
+		t.Fatalf("get %q: got %q (%v)", makeKey(3), v, err)
+	}
+	if db.Has(makeKey(5)) {
+		t.Fatalf("has %q: expected deleted", makeKey(5))
+	}
+
+	// rolled back transactions write nothing
+	x = db.BeginTxn()
+	x.Put(makeKey(30), []byte("gone"))
+	x.Rollback()
+	if err := x.Commit(); err != ErrTxnDone {
+		t.Fatalf("commit after rollback: got %v, want %v", err, ErrTxnDone)
+	}
+	if db.Has(makeKey(30)) {
+		t.Fatalf("expected nothing written by a rolled back transaction")
+	}
+}
+
+func TestTxn_Conflict(t *testing.T) {
+	db := openTestTree(t, t.TempDir())
+	defer db.Close()
+	db.Put("counter", []byte("0"))
+	// a read of a key deleted or created since the snapshot conflicts too
+	for _, write := range []func() error{
+		func() error { return db.Put("counter", []byte("1")) },
+		func() error { _, err := db.Del("counter"); return err },
+		func() error { return db.Put("counter", []byte("0")) },
+		func() error {
+			var b WriteBatch
+			b.DelRange("a", "d")
+			return db.Write(&b)
+		},
+	} {
+		x := db.BeginTxn()
+		x.Get("counter")
+		x.Put("other", nil)
+		if err := write(); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if err := x.Commit(); err != ErrConflict {
+			t.Fatalf("commit: got %v, want %v", err, ErrConflict)
+		}
+	}
+
+	// concurrent read modify write loses no increments
+	db.Put("counter", []byte("0"))
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; {
+				x := db.BeginTxn()
+				v, err := x.Get("counter")
+				if err != nil {
+					t.Errorf("get: %v", err)
+					return
+				}
+				n, _ := strconv.Atoi(string(v))
+				x.Put("counter", []byte(strconv.Itoa(n+1)))
+				err = x.Commit()
+				if err == ErrConflict {
+					continue
+				}
+				if err != nil {
+					t.Errorf("commit: %v", err)
+					return
+				}
+				i++
+			}
+		}()
+	}
+	wg.Wait()
+	if v, err := db.Get("counter"); err != nil || string(v) != "400" {
+		t.Fatalf("counter: got %q (%v), want %q", v, err, "400")
+	}
+}
+
+func TestTxn_Pessimistic(t *testing.T) {
+	db, err := Open(t.TempDir(), &Options{LockTimeout: -1})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer db.Close()
+
+	// locked increments never conflict, so none are retried
+	db.Put("counter", []byte("0"))
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				x := db.BeginPessimisticTxn()
+				v, err := x.GetForUpdate("counter")
+				if err == nil {
+					n, _ := strconv.Atoi(string(v))
+					err = x.Put("counter", []byte(strconv.Itoa(n+1)))
+				}
+				if err == nil {
+					err = x.Commit()
+				}
+				if err != nil {
+					x.Rollback()
+					t.Errorf("increment: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if v, err := db.Get("counter"); err != nil || string(v) != "400" {
+		t.Fatalf("counter: got %q (%v), want %q", v, err, "400")
+	}
+
+	// waiting too long for a lock times out
+	short, err := Open(t.TempDir(), &Options{LockTimeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer short.Close()
+	a, b := short.BeginPessimisticTxn(), short.BeginPessimisticTxn()
+	if err := a.Put("a", []byte("a")); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if err := b.Del("a"); err != ErrLockTimeout {
+		t.Fatalf("del: got %v, want %v", err, ErrLockTimeout)
+	}
+	a.Rollback()
+	b.Rollback()
+
+	// closing a cycle of waits fails straight away,
+	// even with nothing to time out
+	a, b = db.BeginPessimisticTxn(), db.BeginPessimisticTxn()
+	if err := a.Put("a", []byte("a")); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if err := b.Put("b", []byte("b")); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := a.GetForUpdate("b")
+		done <- err
+	}()
+	for waiting := false; !waiting; {
+		time.Sleep(time.Millisecond)
+		db.locks.mu.Lock()
+		_, waiting = db.locks.waitFor[a.id]
+		db.locks.mu.Unlock()
+	}
+	if _, err := b.GetForUpdate("a"); err != ErrDeadlock {
+		t.Fatalf("get for update: got %v, want %v", err, ErrDeadlock)
+	}
+	// and rolling back lets the other one through
+	b.Rollback()
+	if err := <-done; err != ErrNotFound {
+		t.Fatalf("get for update: got %v, want %v", err, ErrNotFound)
+	}
+	if err := a.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if db.Has("b") || !db.Has("a") {
+		t.Fatalf("expected only the committed write")
+	}
+	if n := len(db.locks.locks); n != 0 {
+		t.Fatalf("locks: got %d held, want none", n)
+	}
+}
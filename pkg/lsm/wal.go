@@ -0,0 +1,197 @@
+package lsm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const walExt = ".wal"
+
+// WAL is a write ahead log split into numbered segment files
+// (000001.wal, 000002.wal, ...). Every memtable writes to its own
+// segment and the log is rotated onto a fresh segment whenever the
+// active memtable is sealed. Each segment knows the range of sequence
+// numbers it holds, and a segment is only removed once every record
+// in it has been flushed to an sstable and the sequence number of
+// the last flushed record has been persisted in the manifest.
+type WAL struct {
+	dir      string
+	segments []*walSegment // oldest first, the last one is active
+	nextNum  uint64        // number used to name the next segment
+	flushed  uint64        // every record up to this seq is in an sstable
+	policy   SyncPolicy    // sync policy of the active segment
+}
+
+type walSegment struct {
+	num uint64
+	log *LogFile
+}
+
+// OpenWAL opens every log segment found in dir. flushed is the
+// persisted sequence number up to which every record is already in
+// an sstable. Replay should be called next, followed by Rotate to
+// start the active segment, which is synced according to policy.
+func OpenWAL(dir string, flushed uint64, policy SyncPolicy) (*WAL, error) {
+	w := &WAL{dir: dir, nextNum: 1, flushed: flushed, policy: policy}
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+walExt))
+	if err != nil {
+		return nil, fmt.Errorf("[OpenWAL] listing segments: %v", err)
+	}
+	for _, path := range paths {
+		num, err := parseFileNum(path, walExt)
+		if err != nil {
+			continue
+		}
+		l, err := OpenLogFile(path)
+		if err != nil {
+			w.Close()
+			return nil, fmt.Errorf("[OpenWAL] calling OpenLogFile: %v", err)
+		}
+		w.segments = append(w.segments, &walSegment{num: num, log: l})
+		if num >= w.nextNum {
+			w.nextNum = num + 1
+		}
+	}
+	sort.Slice(w.segments, func(i, j int) bool {
+		return w.segments[i].num < w.segments[j].num
+	})
+	return w, nil
+}
+
+// Flushed returns the sequence number up to which every record
+// has been written to an sstable
+func (w *WAL) Flushed() uint64 {
+	return w.flushed
+}
+
+// Replay replays every segment in order, calling fn for each record
+// that has not already been flushed to an sstable. Segments are
+// closed once replayed, since they are sealed from then on. If replay
+// of a segment stops short at a torn or corrupt record, and what was
+// cut may not have been flushed, every newer segment is removed as
+// well, unless mode is RecoverSkip, so that the log is cut at that
+// point as a whole.
+func (w *WAL) Replay(mode RecoveryMode, fn func(rec *DataRecord) error) error {
+	for i, seg := range w.segments {
+		report, err := seg.log.Replay(mode, func(rec *DataRecord) error {
+			if rec.Seq <= w.flushed {
+				return nil
+			}
+			return fn(rec)
+		})
+		if err != nil {
+			return fmt.Errorf("[WAL.Replay] replaying %s: %w", seg.log.Name(), err)
+		}
+		err = seg.log.Close()
+		if err != nil {
+			return fmt.Errorf("[WAL.Replay] closing %s: %v", seg.log.Name(), err)
+		}
+		if report.Stopped && mode != RecoverSkip && i+1 < len(w.segments) && w.cutUnflushed(i) {
+			return w.removeAfter(i)
+		}
+	}
+	return nil
+}
+
+// cutUnflushed reports whether the records cut from the end of the
+// segment at index i may include any that were not yet flushed. They
+// all come before the first record of the next segment.
+func (w *WAL) cutUnflushed(i int) bool {
+	next := w.segments[i+1].log
+	r := bufio.NewReader(io.NewSectionReader(next.file, 0, next.size))
+	rec, _, err := readRecord(r, next.size)
+	if err != nil {
+		return true
+	}
+	return rec.Seq-1 > w.flushed
+}
+
+// removeAfter removes every segment newer than the one at index i
+func (w *WAL) removeAfter(i int) error {
+	for _, seg := range w.segments[i+1:] {
+		log.Printf("Removing %s after an earlier segment was cut short\n", seg.log.Name())
+		err := seg.log.Close()
+		if err != nil {
+			return fmt.Errorf("[WAL.removeAfter] closing %s: %v", seg.log.Name(), err)
+		}
+		err = os.Remove(seg.log.Name())
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("[WAL.removeAfter] removing %s: %v", seg.log.Name(), err)
+		}
+	}
+	w.segments = w.segments[:i+1]
+	return syncDir(w.dir)
+}
+
+// Rotate starts a new active segment and seals the previous one,
+// if there is one. If the new segment can not be created the
+// previous one is left open and active.
+func (w *WAL) Rotate() (*LogFile, error) {
+	path := filepath.Join(w.dir, fmt.Sprintf("%06d%s", w.nextNum, walExt))
+	l, err := OpenLogFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("[WAL.Rotate] calling OpenLogFile: %v", err)
+	}
+	err = syncDir(w.dir)
+	if err != nil {
+		l.Close()
+		os.Remove(path)
+		return nil, fmt.Errorf("[WAL.Rotate] calling syncDir: %v", err)
+	}
+	l.SetSyncPolicy(w.policy)
+	if n := len(w.segments); n > 0 {
+		active := w.segments[n-1].log
+		err = active.Close()
+		if err != nil {
+			return nil, fmt.Errorf("[WAL.Rotate] sealing %s: %v", active.Name(), err)
+		}
+	}
+	w.segments = append(w.segments, &walSegment{num: w.nextNum, log: l})
+	w.nextNum++
+	return l, nil
+}
+
+// MarkFlushed notes that every record up to and including seq has
+// been durably written to an sstable, and then removes each sealed
+// segment that no longer holds anything newer. The caller must have
+// persisted seq in the manifest first.
+func (w *WAL) MarkFlushed(seq uint64) error {
+	if seq > w.flushed {
+		w.flushed = seq
+	}
+	var removed bool
+	for len(w.segments) > 1 {
+		seg := w.segments[0]
+		if _, last := seg.log.SeqRange(); last > w.flushed {
+			break
+		}
+		err := os.Remove(seg.log.Name())
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("[WAL.MarkFlushed] removing %s: %v", seg.log.Name(), err)
+		}
+		w.segments = w.segments[1:]
+		removed = true
+	}
+	if removed {
+		return syncDir(w.dir)
+	}
+	return nil
+}
+
+// Close closes any segment that is still open, carrying on past
+// any that fail to close and returning the first error
+func (w *WAL) Close() error {
+	var err error
+	for _, seg := range w.segments {
+		cerr := seg.log.Close()
+		if cerr != nil && err == nil {
+			err = fmt.Errorf("[WAL.Close] closing %s: %v", seg.log.Name(), cerr)
+		}
+	}
+	return err
+}
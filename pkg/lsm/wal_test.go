@@ -0,0 +1,243 @@
+package lsm
+
+import (
+	"bytes"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// crashTestTree drops the tree on the floor without flushing, the
+// same way a crash would, leaving whatever is in the log on disk
+func crashTestTree(t *testing.T, db *LSMTree) {
+	db.stopBackground()
+	if err := db.wal.Close(); err != nil {
+		t.Fatalf("close wal: %v", err)
+	}
+	db.manifest.Close()
+	db.tables.close()
+}
+
+func countSegments(t *testing.T, dir string) int {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+walExt))
+	if err != nil {
+		t.Fatalf("glob: %v", err)
+	}
+	return len(paths)
+}
+
+func TestWAL_Recover(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestTree(t, dir)
+	for i := 0; i < 50; i++ {
+		db.Put(makeKey(i), makeVal(i))
+	}
+	db.Flush()
+	for i := 50; i < 100; i++ {
+		db.Put(makeKey(i), makeVal(i))
+	}
+	db.Del(makeKey(75))
+	seq := db.mem.seq
+	crashTestTree(t, db)
+
+	db = openTestTree(t, dir)
+	if db.mem.seq != seq {
+		t.Fatalf("seq: got %d, want %d", db.mem.seq, seq)
+	}
+	for i := 0; i < 100; i++ {
+		val, err := db.Get(makeKey(i))
+		if i == 75 {
+			if err != ErrNotFound {
+				t.Fatalf("get %q: expected deleted, got %q", makeKey(i), val)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(val, makeVal(i)) {
+			t.Fatalf("get %q: got %q (%v)", makeKey(i), val, err)
+		}
+	}
+	// the replayed segment is kept alongside the new active
+	// one until the recovered memtable has been flushed
+	if n := countSegments(t, dir); n != 2 {
+		t.Fatalf("segments: got %d, want %d", n, 2)
+	}
+	db.Put("after", []byte("recovery"))
+	if err := db.Flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if n := countSegments(t, dir); n != 1 {
+		t.Fatalf("segments after flush: got %d, want %d", n, 1)
+	}
+	if f := db.wal.Flushed(); f != seq+1 {
+		t.Fatalf("flushed: got %d, want %d", f, seq+1)
+	}
+	crashTestTree(t, db)
+
+	// nothing is replayed twice once it has been flushed
+	db = openTestTree(t, dir)
+	defer db.Close()
+	if n := db.mem.Len(); n != 0 {
+		t.Fatalf("memtable: got %d entries, want %d", n, 0)
+	}
+	if db.mem.seq != seq+1 {
+		t.Fatalf("seq: got %d, want %d", db.mem.seq, seq+1)
+	}
+	if n, _ := db.Count(); n != 100 {
+		t.Fatalf("count: got %d, want %d", n, 100)
+	}
+}
+
+func TestWAL_SegmentRange(t *testing.T) {
+	dir := t.TempDir()
+	w, err := OpenWAL(dir, 0, DefaultSyncPolicy)
+	if err != nil {
+		t.Fatalf("open wal: %v", err)
+	}
+	defer w.Close()
+	l, err := w.Rotate()
+	if err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	for seq := uint64(5); seq <= 9; seq++ {
+		l.WriteRecord(NewDataRecord(typePut, seq, makeKey(int(seq)), nil))
+	}
+	if first, last := l.SeqRange(); first != 5 || last != 9 {
+		t.Fatalf("range: got %d-%d, want 5-9", first, last)
+	}
+	if _, err = w.Rotate(); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	// not everything in the sealed segment is flushed yet
+	if err = w.MarkFlushed(8); err != nil {
+		t.Fatalf("mark flushed: %v", err)
+	}
+	if n := countSegments(t, dir); n != 2 {
+		t.Fatalf("segments: got %d, want %d", n, 2)
+	}
+	if err = w.MarkFlushed(9); err != nil {
+		t.Fatalf("mark flushed: %v", err)
+	}
+	if n := countSegments(t, dir); n != 1 {
+		t.Fatalf("segments: got %d, want %d", n, 1)
+	}
+	if seq := w.Flushed(); seq != 9 {
+		t.Fatalf("flushed seq: got %d, want %d", seq, 9)
+	}
+}
+
+func TestWAL_GroupCommit(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestTree(t, dir)
+	const writers, each = 16, 100
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w * each; i < (w+1)*each; i++ {
+				if err := db.Put(makeKey(i), makeVal(i)); err != nil {
+					t.Errorf("put: %v", err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	// every write got its own sequence number
+	if db.mem.seq != writers*each {
+		t.Fatalf("seq: got %d, want %d", db.mem.seq, writers*each)
+	}
+	crashTestTree(t, db)
+
+	// everything that was acknowledged survives the crash
+	db = openTestTree(t, dir)
+	defer db.Close()
+	for i := 0; i < writers*each; i++ {
+		val, err := db.Get(makeKey(i))
+		if err != nil || !bytes.Equal(val, makeVal(i)) {
+			t.Fatalf("get %q: got %q (%v)", makeKey(i), val, err)
+		}
+	}
+}
+
+func TestMemtable_GroupCommit(t *testing.T) {
+	mem, err := NewMemtable(filepath.Join(t.TempDir(), "wal.log"), false)
+	if err != nil {
+		t.Fatalf("new memtable: %v", err)
+	}
+	defer mem.Close()
+	const writers, each = 8, 50
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w * each; i < (w+1)*each; i++ {
+				if err := mem.Put(makeKey(i), makeVal(i)); err != nil {
+					t.Errorf("put: %v", err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	if n := mem.Len(); n != writers*each {
+		t.Fatalf("len: got %d, want %d", n, writers*each)
+	}
+	// a sync is never issued for more than one group, so
+	// there can not be more syncs than there were writes
+	if mem.wal.syncs > writers*each {
+		t.Fatalf("syncs: got %d for %d writes", mem.wal.syncs, writers*each)
+	}
+	// the log holds every record once, numbered in log order
+	recs := replayTestRecords(t, mem.wal.Name())
+	if len(recs) != writers*each {
+		t.Fatalf("replay: got %d records, want %d", len(recs), writers*each)
+	}
+	for i, rec := range recs {
+		if rec.Seq != uint64(i+1) {
+			t.Fatalf("replay: record %d has seq %d", i, rec.Seq)
+		}
+	}
+}
+
+func TestWAL_ReplayCorruptSegment(t *testing.T) {
+	for _, flushed := range []uint64{0, 10} {
+		dir := t.TempDir()
+		recs, _ := corruptTestLog(t, filepath.Join(dir, "000001"+walExt), 4)
+		l, err := OpenLogFile(filepath.Join(dir, "000002"+walExt))
+		if err != nil {
+			t.Fatalf("open log: %v", err)
+		}
+		recs = append(recs, writeTestRecords(t, l, 10, 10)...)
+		l.Close()
+
+		w, err := OpenWAL(dir, flushed, DefaultSyncPolicy)
+		if err != nil {
+			t.Fatalf("open wal: %v", err)
+		}
+		var got []*DataRecord
+		err = w.Replay(RecoverTruncate, func(rec *DataRecord) error {
+			got = append(got, rec)
+			return nil
+		})
+		w.Close()
+		if err != nil {
+			t.Fatalf("replay: %v", err)
+		}
+		if flushed == 0 {
+			// nothing after the corrupt record is replayed, not
+			// even the records in the newer segment
+			assertRecords(t, recs[:4], got)
+			if n := countSegments(t, dir); n != 1 {
+				t.Fatalf("segments: got %d, want %d", n, 1)
+			}
+			continue
+		}
+		// everything cut had been flushed already, so
+		// the newer segment is replayed as usual
+		assertRecords(t, recs[10:], got)
+		if n := countSegments(t, dir); n != 2 {
+			t.Fatalf("segments: got %d, want %d", n, 2)
+		}
+	}
+}